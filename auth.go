@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Principal is who a request is made by, as proven by its access token
+type Principal struct {
+	UserId    int
+	Role      string
+	TokenId   string
+	ExpiresAt time.Time
+}
+
+// HasRole reports whether the principal's role is at least role
+func (p Principal) HasRole(role string) bool {
+	return hasRole(p.Role, role)
+}
+
+type principalKey struct{}
+
+// principalFrom returns the principal RequireAuth stored in ctx
+func principalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// RequireAuth validates the bearer access token once and hands the
+// request on with its Principal in the context. Anything missing,
+// invalid or revoked gets a 401 before next runs.
+func (cfg *apiConfig) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		if header == "" {
+			respondUnauthorized(w, "", "No Authorization Token")
+			return
+		}
+		tokenString, found := strings.CutPrefix(header, "Bearer ")
+		if !found || tokenString == "" {
+			respondUnauthorized(w, "invalid_request", "Authorization must be a Bearer token")
+			return
+		}
+
+		claims, err := parseJWT(tokenString)
+		if err != nil {
+			respondUnauthorized(w, "invalid_token", "Invalid or expired token")
+			return
+		}
+		userId, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			respondUnauthorized(w, "invalid_token", "Invalid or expired token")
+			return
+		}
+
+		revoked, err := cfg.DB.AccessTokenRevoked(claims.ID, userId, claims.Version)
+		if err != nil {
+			log.Printf("checking token revocation: %v", err)
+			respondWithError(w, 500, "Something went wrong")
+			return
+		}
+		if revoked {
+			respondUnauthorized(w, "invalid_token", "Token has been revoked")
+			return
+		}
+
+		principal := Principal{
+			UserId:    userId,
+			Role:      claims.Role,
+			TokenId:   claims.ID,
+			ExpiresAt: claims.ExpiresAt.Time,
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), principalKey{}, principal)))
+	})
+}
+
+// respondUnauthorized writes a 401 with the WWW-Authenticate challenge
+// of RFC 6750, errorCode is left out when no credentials were sent
+func respondUnauthorized(w http.ResponseWriter, errorCode string, msg string) {
+	challenge := `Bearer realm="chirpy"`
+	if errorCode != "" {
+		challenge += `, error="` + errorCode + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	respondWithError(w, 401, msg)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is everything that can be set on the command line.
+// Flags default to the matching environment variable (or .env)
+// when there is one.
+type Config struct {
+	DBDriver       string
+	DBPath         string
+	ResetDB        bool
+	Debug          bool
+	PublicIdFormat string
+
+	RestoreWindow  time.Duration
+	ChirpRetention time.Duration
+	PurgeInterval  time.Duration
+
+	WordListPath    string
+	MaskStyle       string
+	ReportThreshold int
+
+	AdminEmail string
+
+	JWTKeysDir    string
+	JWTSigningKey string
+	JWTIssuer     string
+	JWTAudience   string
+
+	AccessTTL     time.Duration
+	MaxAccessTTL  time.Duration
+	RefreshTTL    time.Duration
+	MaxRefreshTTL time.Duration
+	RefreshGrace  time.Duration
+
+	PolkaKeys        []string
+	PolkaApiKey      bool
+	WebhookTolerance time.Duration
+
+	SubscriptionPeriod time.Duration
+	SubscriptionGrace  time.Duration
+	PlansPath          string
+
+	DeliveryInterval  time.Duration
+	DeliveryAttempts  int
+	DeliveryBackoff   time.Duration
+	DeliveryRetention time.Duration
+	WebhookPrivate    bool
+}
+
+func loadConfig(args []string) (Config, error) {
+	cfg := Config{}
+
+	flags := flag.NewFlagSet("piupiu", flag.ContinueOnError)
+	flags.StringVar(&cfg.DBDriver, "db-driver", envOr("DB_DRIVER", "json"), "database driver, json or sqlite")
+	flags.StringVar(&cfg.DBPath, "db-path", os.Getenv("DB_PATH"), "database file (default database.json, or database.db for sqlite)")
+	flags.BoolVar(&cfg.ResetDB, "reset-db", false, "delete the database before starting")
+	flags.BoolVar(&cfg.Debug, "debug", false, "debug mode, implies --reset-db so every run starts empty")
+	flags.StringVar(&cfg.PublicIdFormat, "public-ids", os.Getenv("PUBLIC_ID_FORMAT"), "public ids for chirps and users: uuid, ulid or empty for none")
+	flags.DurationVar(&cfg.RestoreWindow, "restore-window", 24*time.Hour, "how long the author of a deleted chirp can restore it")
+	flags.DurationVar(&cfg.ChirpRetention, "chirp-retention", 30*24*time.Hour, "how long deleted chirps are kept before being purged")
+	flags.DurationVar(&cfg.PurgeInterval, "purge-interval", time.Hour, "how often deleted chirps and delivered webhooks past their retention, expired sessions and revoked tokens are purged, and lapsed subscriptions ended")
+
+	flags.StringVar(&cfg.WordListPath, "wordlist", envOr("WORDLIST", "wordlist.txt"), "moderation word list, one word per line")
+	flags.StringVar(&cfg.MaskStyle, "mask-style", envOr("MASK_STYLE", "fixed"), "how matched words are masked: fixed, full, first or grawlix")
+	flags.IntVar(&cfg.ReportThreshold, "report-threshold", 3, "open reports after which a chirp is hidden until a moderator looks at it, 0 never hides")
+	flags.StringVar(&cfg.AdminEmail, "admin-email", os.Getenv("ADMIN_EMAIL"), "existing user promoted to admin at startup")
+	flags.StringVar(&cfg.JWTKeysDir, "jwt-keys", os.Getenv("JWT_KEYS"), "directory of extra token keys: <kid>.secret, <kid>.pem or <kid>.pub.pem")
+	flags.StringVar(&cfg.JWTSigningKey, "jwt-signing-key", os.Getenv("JWT_SIGNING_KEY"), "kid of the key new tokens are signed with, JWT_SECRET is \"default\"")
+	flags.StringVar(&cfg.JWTIssuer, "jwt-issuer", envOr("JWT_ISSUER", "chirpy"), "iss of access tokens")
+	flags.StringVar(&cfg.JWTAudience, "jwt-audience", envOr("JWT_AUDIENCE", "chirpy"), "aud of access tokens")
+	flags.DurationVar(&cfg.AccessTTL, "access-ttl", time.Hour, "lifetime of access tokens when login doesn't ask for one")
+	flags.DurationVar(&cfg.MaxAccessTTL, "max-access-ttl", 24*time.Hour, "longest access token lifetime login can ask for")
+	flags.DurationVar(&cfg.RefreshTTL, "refresh-ttl", 60*24*time.Hour, "lifetime of refresh tokens when login doesn't ask for one")
+	flags.DurationVar(&cfg.MaxRefreshTTL, "max-refresh-ttl", 60*24*time.Hour, "longest refresh token lifetime login can ask for")
+	flags.DurationVar(&cfg.RefreshGrace, "refresh-grace", 10*time.Second, "how long a rotated refresh token is still accepted, for concurrent refreshes")
+	polkaKeys := flags.String("polka-keys", os.Getenv("POLKA_KEY"), "comma separated Polka webhook secrets, any of them is accepted so they can be rotated")
+	flags.BoolVar(&cfg.PolkaApiKey, "polka-api-key", false, "deprecated: also accept unsigned webhooks with an Authorization: ApiKey header, while migrating to signatures")
+	flags.DurationVar(&cfg.WebhookTolerance, "webhook-tolerance", 5*time.Minute, "how far a signed webhook's timestamp may be from now")
+	flags.DurationVar(&cfg.SubscriptionPeriod, "subscription-period", 30*24*time.Hour, "how long a Chirpy Red payment lasts when Polka doesn't say")
+	flags.DurationVar(&cfg.SubscriptionGrace, "subscription-grace", 3*24*time.Hour, "how long Chirpy Red is kept after a subscription is due when the renewal is late")
+	flags.StringVar(&cfg.PlansPath, "plans", envOr("PLANS", "plans.json"), "what each plan can do, defaults are used for plans it leaves out")
+	flags.DurationVar(&cfg.DeliveryInterval, "delivery-interval", 5*time.Second, "how often outbound webhooks that are due are sent")
+	flags.IntVar(&cfg.DeliveryAttempts, "delivery-attempts", 8, "attempts at an outbound webhook before it is dead")
+	flags.DurationVar(&cfg.DeliveryBackoff, "delivery-backoff", 30*time.Second, "wait after the first failed attempt, doubled after each one")
+	flags.DurationVar(&cfg.DeliveryRetention, "delivery-retention", 7*24*time.Hour, "how long delivered outbound webhooks are kept in the delivery log before being purged")
+	flags.BoolVar(&cfg.WebhookPrivate, "webhook-allow-private", false, "let outbound webhook endpoints be on loopback and private addresses")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if cfg.DBPath == "" {
+		cfg.DBPath = "database.json"
+		if cfg.DBDriver == "sqlite" {
+			cfg.DBPath = "database.db"
+		}
+	}
+	if cfg.Debug {
+		cfg.ResetDB = true
+	}
+	cfg.PolkaKeys = splitSecrets(*polkaKeys)
+
+	if cfg.ChirpRetention < cfg.RestoreWindow {
+		return Config{}, fmt.Errorf("--chirp-retention must not be shorter than --restore-window")
+	}
+	if cfg.PurgeInterval <= 0 {
+		return Config{}, fmt.Errorf("--purge-interval must be positive")
+	}
+	if cfg.AccessTTL <= 0 || cfg.AccessTTL > cfg.MaxAccessTTL {
+		return Config{}, fmt.Errorf("--access-ttl must be positive and not longer than --max-access-ttl")
+	}
+	if cfg.RefreshTTL <= 0 || cfg.RefreshTTL > cfg.MaxRefreshTTL {
+		return Config{}, fmt.Errorf("--refresh-ttl must be positive and not longer than --max-refresh-ttl")
+	}
+	if cfg.RefreshGrace < 0 {
+		return Config{}, fmt.Errorf("--refresh-grace must not be negative")
+	}
+	if cfg.WebhookTolerance <= 0 {
+		return Config{}, fmt.Errorf("--webhook-tolerance must be positive")
+	}
+	if cfg.SubscriptionPeriod <= 0 || cfg.SubscriptionGrace < 0 {
+		return Config{}, fmt.Errorf("--subscription-period must be positive and --subscription-grace not negative")
+	}
+	if cfg.DeliveryInterval <= 0 || cfg.DeliveryAttempts <= 0 || cfg.DeliveryBackoff <= 0 || cfg.DeliveryRetention <= 0 {
+		return Config{}, fmt.Errorf("--delivery-interval, --delivery-attempts, --delivery-backoff and --delivery-retention must be positive")
+	}
+	if cfg.ReportThreshold < 0 {
+		return Config{}, fmt.Errorf("--report-threshold must not be negative")
+	}
+
+	err = validPublicIdFormat(cfg.PublicIdFormat)
+	if err != nil {
+		return Config{}, err
+	}
+	err = validMaskStyle(cfg.MaskStyle)
+	if err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
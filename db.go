@@ -3,182 +3,382 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"log"
 	"os"
+	"reflect"
 	"sort"
 	"sync"
+	"time"
 )
 
+// DB is a Store kept in memory and persisted as a JSON snapshot plus
+// an append-only log of the transactions committed since the snapshot
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path       string
+	logPath    string
+	logEntries int
+	mux        *sync.RWMutex
+	data       DBStructure
 }
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	Chirps    map[int]Chirp  `json:"chirps"`
+	Users     map[int]User   `json:"users"`
+	Sequences map[string]int `json:"sequences"`
+
+	// ChirpHistory holds the previous versions of each edited chirp
+	ChirpHistory map[int][]ChirpVersion `json:"chirp_history"`
+
+	Reports map[int]Report `json:"reports"`
+
+	// Sessions are keyed by the SHA-256 of their refresh token
+	Sessions map[string]Session `json:"sessions"`
+
+	// RevokedTokens is the access token denylist, keyed by jti
+	RevokedTokens map[string]RevokedToken `json:"revoked_tokens"`
+
+	WebhookEvents map[int]WebhookEvent `json:"webhook_events"`
+
+	WebhookEndpoints  map[int]WebhookEndpoint `json:"webhook_endpoints"`
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhook_deliveries"`
+
+	Migrations map[string]time.Time `json:"migrations"`
+
+	// journal tracks the writes of the Update in progress
+	journal *journal
 }
 
 // NewDB creates a new database connection
-// and creates the database file if it doesn't exist
+// and creates the database file if it doesn't exist.
+// Any log left behind by a previous run is replayed
+// and compacted into the snapshot.
 func NewDB(path string) (*DB, error) {
-	_, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		empty_db, _ := json.Marshal(new(DBStructure))
-
-		err := os.WriteFile(path, empty_db, 0666)
-		if err != nil {
-			log.Fatal(err)
-			return nil, err
-		}
-	}
-
 	db := DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:    path,
+		logPath: path + ".log",
+		mux:     &sync.RWMutex{},
 	}
-	return &db, err
-}
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	err := db.ensureDB()
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		err = writeSnapshot(path, DBStructure{})
+	}
 	if err != nil {
-		return Chirp{}, err
+		return nil, err
 	}
 
-	dbStructure, err := db.loadDB()
+	db.data, err = db.readDB()
 	if err != nil {
-		return Chirp{}, err
+		return nil, err
 	}
-
-	chirpId := len(dbStructure.Chirps) + 1
-
-	newChirp := Chirp{
-		Id:       chirpId,
-		Body:     cleanBody(body),
-		AuthorId: authorId,
+	err = db.compact(db.data)
+	if err != nil {
+		return nil, err
 	}
-	if dbStructure.Chirps == nil {
-		dbStructure.Chirps = map[int]Chirp{}
+
+	err = db.migrate()
+	if err != nil {
+		return nil, err
 	}
+	return &db, nil
+}
+
+// Close is a no-op, every transaction is synced to the log as it commits
+func (db *DB) Close() error {
+	return nil
+}
 
-	dbStructure.Chirps[chirpId] = newChirp
-	err = db.writeDB(dbStructure)
+// View runs fn with the current state of the database.
+// fn must not modify tx, use Update for that.
+func (db *DB) View(fn func(tx *DBStructure) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	return newChirp, err
+	return fn(&db.data)
 }
 
-func (db *DB) DeleteChirp(chirpId int, userId int) error {
-	err := db.ensureDB()
+// Update runs fn on the database and, if fn returns nil, persists
+// the changes it made as a single log entry. fn must write through
+// tx.put and tx.remove, which journal the keys it touches: only those
+// are logged, and they are put back if fn fails or the log can't be
+// written. Writers are serialized, so fn always sees the latest state.
+// fn should replace map values rather than mutate them in place.
+func (db *DB) Update(fn func(tx *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	tx := &db.data
+	tx.journal = &journal{previous: map[journalKey]reflect.Value{}}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+		tx.journal = nil
+	}()
+
+	err := fn(tx)
 	if err != nil {
 		return err
 	}
 
-	dbStructure, err := db.loadDB()
-
-	if dbStructure.Chirps[chirpId].AuthorId != userId {
-		return errors.New("Not authorized")
+	records, err := tx.records()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		committed = true
+		return nil
 	}
 
-	delete(dbStructure.Chirps, chirpId)
-	db.writeDB(dbStructure)
+	err = appendLog(db.logPath, records)
+	if err != nil {
+		return err
+	}
+	committed = true
+	db.logEntries++
 
+	// the write is durable in the log whatever happens to the
+	// snapshot, a failed compaction is retried on the next write
+	if db.logEntries >= compactEvery {
+		err = db.compact(db.data)
+		if err != nil {
+			log.Printf("compacting %s: %v", db.path, err)
+		}
+	}
 	return nil
 }
 
-// // GetChirps returns all chirps in the database
-func (db *DB) GetChirps() ([]Chirp, error) {
+// clone copies every table, nil ones come out empty
+func (dbStructure DBStructure) clone() DBStructure {
+	clone := DBStructure{}
+	cloneTables := clone.tables()
+	for name, table := range dbStructure.tables() {
+		cloned := reflect.MakeMapWithSize(table.Type(), table.Len())
+		iter := table.MapRange()
+		for iter.Next() {
+			cloned.SetMapIndex(iter.Key(), iter.Value())
+		}
+		cloneTables[name].Set(cloned)
+	}
+	return clone
+}
+
+// CreateChirp creates a new chirp and saves it to disk. When perHour
+// isn't 0 and the author already created that many chirps in the last
+// hour, deleted ones included, it returns ErrRateLimited instead.
+func (db *DB) CreateChirp(body string, authorId int, perHour int) (Chirp, error) {
+	newChirp := Chirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		now := time.Now().UTC()
+		chirpId := tx.nextId("chirps")
+
+		if perHour > 0 {
+			// ids go up with creation time, walking down from the
+			// newest only looks at the chirps of the last hour
+			recent := 0
+			for id := chirpId - 1; id > 0; id-- {
+				chirp, exists := tx.Chirps[id]
+				if !exists {
+					continue
+				}
+				if !chirp.CreatedAt.After(now.Add(-time.Hour)) {
+					break
+				}
+				if chirp.AuthorId == authorId {
+					recent++
+				}
+			}
+			if recent >= perHour {
+				return ErrRateLimited
+			}
+		}
 
-	err := db.ensureDB()
+		newChirp = Chirp{
+			Id:        chirpId,
+			PublicId:  newPublicId(),
+			Body:      cleanBody(body),
+			AuthorId:  authorId,
+			Version:   1,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		tx.put("chirps", chirpId, newChirp)
+		return nil
+	})
 	if err != nil {
-		return []Chirp{}, err
+		return Chirp{}, err
 	}
 
-	dbStructure, err := db.loadDB()
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+	return newChirp, nil
+}
 
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
-	for _, value := range dbStructure.Chirps {
-		chirps = append(chirps, value)
-	}
+// DeleteChirp soft deletes a chirp: it disappears from every read
+// but can be restored by its author until it is purged. Authors can
+// delete their chirps hidden by reports too, for everyone else those
+// don't exist.
+func (db *DB) DeleteChirp(chirpId int, userId int) error {
+	return db.Update(func(tx *DBStructure) error {
+		chirp, exists := tx.Chirps[chirpId]
+		if !exists || chirp.DeletedAt != nil || (chirp.HiddenAt != nil && chirp.AuthorId != userId) {
+			return ErrNotFound
+		}
+		if chirp.AuthorId != userId {
+			return ErrNotAuthorized
+		}
 
-	sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id > chirps[i].Id })
-	return chirps, nil
+		now := time.Now().UTC()
+		chirp.DeletedAt = &now
+		tx.put("chirps", chirpId, chirp)
+		return nil
+	})
 }
 
-func (db *DB) GetUserChirps(userId int, sortMethod string) ([]Chirp, error) {
+// RestoreChirp undoes DeleteChirp as long as the chirp was deleted
+// after deletedAfter. Restoring a chirp that isn't deleted is a no-op.
+func (db *DB) RestoreChirp(chirpId int, userId int, deletedAfter time.Time) (Chirp, error) {
+	restored := Chirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		chirp, exists := tx.Chirps[chirpId]
+		if !exists {
+			return ErrNotFound
+		}
+		if chirp.AuthorId != userId {
+			return ErrNotAuthorized
+		}
+		if chirp.DeletedAt != nil {
+			if chirp.DeletedAt.Before(deletedAfter) {
+				return ErrExpired
+			}
+			chirp.DeletedAt = nil
+			tx.put("chirps", chirpId, chirp)
+		}
+
+		restored = chirp
+		return nil
+	})
+	return restored, err
+}
 
-	err := db.ensureDB()
+// PurgeDeletedChirps hard deletes chirps soft deleted before deletedBefore
+func (db *DB) PurgeDeletedChirps(deletedBefore time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *DBStructure) error {
+		for id, chirp := range tx.Chirps {
+			if chirp.DeletedAt != nil && chirp.DeletedAt.Before(deletedBefore) {
+				tx.remove("chirps", id)
+				tx.remove("chirp_history", id)
+				purged++
+			}
+		}
+		for id, report := range tx.Reports {
+			if _, exists := tx.Chirps[report.ChirpId]; !exists {
+				tx.remove("reports", id)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return []Chirp{}, err
+		return 0, err
 	}
+	return purged, nil
+}
 
-	dbStructure, err := db.loadDB()
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// EditChirp replaces the body of a chirp, keeping the old one in its history
+func (db *DB) EditChirp(chirpId int, userId int, body string) (Chirp, error) {
+	edited := Chirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		chirp, exists := tx.Chirps[chirpId]
+		if !exists || !chirp.visible() {
+			return ErrNotFound
+		}
+		if chirp.AuthorId != userId {
+			return ErrNotAuthorized
+		}
 
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
-	for _, value := range dbStructure.Chirps {
-		if value.AuthorId == userId {
-			chirps = append(chirps, value)
+		now := time.Now().UTC()
+		previous := ChirpVersion{
+			ChirpId:    chirp.Id,
+			Version:    chirp.Version,
+			Body:       chirp.Body,
+			CreatedAt:  chirp.UpdatedAt,
+			ReplacedAt: now,
 		}
-	}
+		// cap the slice so append never writes into the committed history
+		history := tx.ChirpHistory[chirpId]
+		tx.put("chirp_history", chirpId, append(history[:len(history):len(history)], previous))
+
+		chirp.Body = cleanBody(body)
+		chirp.Version++
+		chirp.UpdatedAt = now
+		tx.put("chirps", chirpId, chirp)
+
+		edited = chirp
+		return nil
+	})
+	return edited, err
+}
 
-	if sortMethod == "asc" {
-		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id > chirps[i].Id })
-	} else {
-		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id > chirps[i].Id })
-	}
-	return chirps, nil
+func (db *DB) GetChirpHistory(chirpId int) ([]ChirpVersion, error) {
+	history := []ChirpVersion{}
+	err := db.View(func(tx *DBStructure) error {
+		if chirp, exists := tx.Chirps[chirpId]; !exists || !chirp.visible() {
+			return ErrNotFound
+		}
+		history = append(history, tx.ChirpHistory[chirpId]...)
+		return nil
+	})
+	return history, err
 }
-func (db *DB) GetChirp(id int) (Chirp, error) {
-	err := db.ensureDB()
-	if err != nil {
-		return Chirp{}, err
-	}
 
-	dbStructure, err := db.loadDB()
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// GetChirps returns the chirps matching q, in q's order
+func (db *DB) GetChirps(q ChirpQuery) ([]Chirp, string, error) {
+	chirps := []Chirp{}
+	db.View(func(tx *DBStructure) error {
+		for _, value := range tx.Chirps {
+			if value.visible() && q.matches(value) {
+				chirps = append(chirps, value)
+			}
+		}
+		return nil
+	})
 
-	chirp, exists := dbStructure.Chirps[id]
-	if exists {
-		return chirp, nil
-	} else {
-		return Chirp{}, errors.New("does not exist")
-	}
+	sort.Slice(chirps, func(i, j int) bool { return q.less(chirps[i], chirps[j]) })
+	return paginate(chirps, q)
 }
 
-// // ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	_, err := os.ReadFile(db.path)
-	if os.IsNotExist(err) {
-		empty_db, _ := json.Marshal(new(DBStructure))
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		existing, exists := tx.Chirps[id]
+		if !exists || !existing.visible() {
+			return ErrNotFound
+		}
+		chirp = existing
+		return nil
+	})
+	return chirp, err
+}
 
-		err := os.WriteFile(db.path, empty_db, 0666)
-		if err != nil {
-			log.Fatal(err)
-			return err
+func (db *DB) GetChirpByPublicId(publicId string) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, existing := range tx.Chirps {
+			if publicId != "" && existing.PublicId == publicId && existing.visible() {
+				chirp = existing
+				return nil
+			}
 		}
-	}
-	return nil
+		return ErrNotFound
+	})
+	return chirp, err
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	err := db.ensureDB()
+// readDB reads the snapshot and replays the log on top of it
+func (db *DB) readDB() (DBStructure, error) {
+	db_data, err := os.ReadFile(db.path)
 	if err != nil {
 		return DBStructure{}, err
 	}
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	db_data, _ := os.ReadFile(db.path)
 	decoder := json.NewDecoder(bytes.NewReader(db_data))
 
 	db_structure := DBStructure{}
@@ -187,28 +387,28 @@ func (db *DB) loadDB() (DBStructure, error) {
 		return db_structure, err
 	}
 
-	return db_structure, nil
-}
-
-// // writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-
-	err := db.ensureDB()
+	db.logEntries, err = replayLog(db.logPath, &db_structure)
 	if err != nil {
-		return err
+		return db_structure, err
 	}
-	db.mux.Lock()
-	defer db.mux.Unlock()
 
-	data, err := json.Marshal(dbStructure)
+	// never hand out nil maps to transactions
+	return db_structure.clone(), nil
+}
+
+// compact folds dbStructure into a fresh snapshot and empties the log.
+// Replaying a log over a snapshot that already contains it is harmless,
+// so a crash between the two steps loses nothing.
+func (db *DB) compact(dbStructure DBStructure) error {
+	err := writeSnapshot(db.path, dbStructure)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.path, data, 0666)
-	if err != nil {
+	err = os.Remove(db.logPath)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-
+	db.logEntries = 0
 	return nil
 }
@@ -0,0 +1,146 @@
+package main
+
+import "time"
+
+// jsonMigrations upgrade data written by older versions of the JSON
+// store. Each runs once, in order, when the database is opened and
+// is recorded in DBStructure.Migrations. Append, never reorder.
+// A migration that rewrites sets the snapshot to be rewritten and the
+// log removed once it ran, for data that must not stay on disk.
+var jsonMigrations = []struct {
+	name    string
+	run     func(tx *DBStructure, now time.Time)
+	rewrite bool
+}{
+	{"0001_timestamps", backfillTimestamps, false},
+	{"0002_chirp_versions", backfillChirpVersions, false},
+	{"0003_roles", backfillRoles, false},
+	{"0004_session_families", backfillSessionFamilies, false},
+	{"0005_subscriptions", backfillSubscriptions, false},
+	{"0006_drop_plaintext_refresh_tokens", dropPlaintextRefreshTokens, true},
+}
+
+// migrate runs the migrations that have not been applied yet
+func (db *DB) migrate() error {
+	rewrite := false
+	err := db.Update(func(tx *DBStructure) error {
+		now := time.Now().UTC()
+		for _, migration := range jsonMigrations {
+			if _, applied := tx.Migrations[migration.name]; applied {
+				continue
+			}
+			migration.run(tx, now)
+			tx.put("migrations", migration.name, now)
+			rewrite = rewrite || migration.rewrite
+		}
+		backfillPublicIds(tx)
+		return nil
+	})
+	if err != nil || !rewrite {
+		return err
+	}
+	return db.compact(db.data)
+}
+
+// backfillPublicIds gives a public id to the chirps and users created
+// while public ids were off. It isn't one of jsonMigrations because
+// they can be turned on at any time, so it runs on every open.
+func backfillPublicIds(tx *DBStructure) {
+	if publicIdFormat == "" {
+		return
+	}
+	for id, chirp := range tx.Chirps {
+		if chirp.PublicId == "" {
+			chirp.PublicId = newPublicIdAt(chirp.CreatedAt)
+			tx.put("chirps", id, chirp)
+		}
+	}
+	for id, user := range tx.Users {
+		if user.PublicId == "" {
+			user.PublicId = newPublicIdAt(user.CreatedAt)
+			tx.put("users", id, user)
+		}
+	}
+}
+
+// backfillTimestamps stamps records created before chirps and
+// users had timestamps with the time of the migration
+func backfillTimestamps(tx *DBStructure, now time.Time) {
+	for id, chirp := range tx.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt = now
+		}
+		if chirp.UpdatedAt.IsZero() {
+			chirp.UpdatedAt = chirp.CreatedAt
+		}
+		tx.put("chirps", id, chirp)
+	}
+	for id, user := range tx.Users {
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = now
+		}
+		if user.UpdatedAt.IsZero() {
+			user.UpdatedAt = user.CreatedAt
+		}
+		tx.put("users", id, user)
+	}
+}
+
+// backfillChirpVersions starts every chirp from before edits at version 1
+func backfillChirpVersions(tx *DBStructure, now time.Time) {
+	for id, chirp := range tx.Chirps {
+		if chirp.Version == 0 {
+			chirp.Version = 1
+			tx.put("chirps", id, chirp)
+		}
+	}
+}
+
+// backfillRoles makes every user from before roles a plain user
+func backfillRoles(tx *DBStructure, now time.Time) {
+	for id, user := range tx.Users {
+		if user.Role == "" {
+			user.Role = roleUser
+			tx.put("users", id, user)
+		}
+	}
+}
+
+// backfillSessionFamilies starts a family with every session
+// created before refresh tokens were rotated
+func backfillSessionFamilies(tx *DBStructure, now time.Time) {
+	for hash, session := range tx.Sessions {
+		if session.FamilyId == 0 {
+			session.FamilyId = session.Id
+			tx.put("sessions", hash, session)
+		}
+	}
+}
+
+// backfillSubscriptions gives every user a subscription. Users who
+// were upgraded before subscriptions keep Chirpy Red with no end date
+// until Polka next tells us about them.
+func backfillSubscriptions(tx *DBStructure, now time.Time) {
+	for id, user := range tx.Users {
+		if user.Subscription.Plan != "" {
+			continue
+		}
+		user.Subscription = noSubscription
+		if user.IsChirpyRed {
+			startedAt := user.UpdatedAt
+			user.Subscription = Subscription{
+				Plan:      planChirpyRed,
+				Status:    "active",
+				StartedAt: &startedAt,
+			}
+		}
+		tx.put("users", id, user)
+	}
+}
+
+// dropPlaintextRefreshTokens gets rid of the refresh_token and
+// expires_in_seconds_refresh users had before sessions, which
+// invalidates those tokens. User no longer has the fields, so reading
+// the database already dropped them, the snapshot rewrite that
+// follows this migration takes them off the disk.
+func dropPlaintextRefreshTokens(tx *DBStructure, now time.Time) {}
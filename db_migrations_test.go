@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDropPlaintextRefreshTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	snapshot := `{"users":{"1":{"id":1,"email":"alice@example.com","password":"hash",` +
+		`"refresh_token":"plaintext-alice","expires_in_seconds_refresh":"2024-01-01T00:00:00Z"}},` +
+		`"migrations":{"0001_timestamps":"2024-01-01T00:00:00Z"}}`
+	log := `{"records":[{"op":"create","table":"users","key":"2","data":{"id":2,"email":"bob@example.com",` +
+		`"password":"hash","refresh_token":"plaintext-bob"}}]}` + "\n"
+	err := os.WriteFile(path, []byte(snapshot), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".log", []byte(log), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUsers(t, db, map[int]string{1: "alice@example.com", 2: "bob@example.com"})
+	applied := false
+	db.View(func(tx *DBStructure) error {
+		_, applied = tx.Migrations["0006_drop_plaintext_refresh_tokens"]
+		return nil
+	})
+	if !applied {
+		t.Error("0006_drop_plaintext_refresh_tokens was not recorded")
+	}
+
+	if _, err := os.Stat(path + ".log"); !os.IsNotExist(err) {
+		t.Errorf("log was not removed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leftover := range []string{`"refresh_token"`, `"expires_in_seconds_refresh"`, "plaintext-"} {
+		if strings.Contains(string(data), leftover) {
+			t.Errorf("%q is still in the snapshot", leftover)
+		}
+	}
+}
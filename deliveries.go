@@ -0,0 +1,182 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func (db *DB) CreateWebhookEndpoint(userId int, url string, events []string, allUsers bool, secret string) (WebhookEndpoint, error) {
+	endpoint := WebhookEndpoint{}
+	err := db.Update(func(tx *DBStructure) error {
+		if _, exists := tx.Users[userId]; !exists {
+			return ErrNotFound
+		}
+
+		endpoint = WebhookEndpoint{
+			Id:        tx.nextId("webhook_endpoints"),
+			UserId:    userId,
+			URL:       url,
+			Events:    append([]string(nil), events...),
+			AllUsers:  allUsers,
+			Secret:    secret,
+			CreatedAt: time.Now().UTC(),
+		}
+		tx.put("webhook_endpoints", endpoint.Id, endpoint)
+		return nil
+	})
+	return endpoint, err
+}
+
+// GetWebhookEndpoints lists the endpoints a user registered, oldest first
+func (db *DB) GetWebhookEndpoints(userId int) ([]WebhookEndpoint, error) {
+	endpoints := []WebhookEndpoint{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, endpoint := range tx.WebhookEndpoints {
+			if endpoint.UserId == userId {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		return nil
+	})
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Id < endpoints[j].Id })
+	return endpoints, err
+}
+
+func (db *DB) GetWebhookEndpoint(id int) (WebhookEndpoint, error) {
+	endpoint := WebhookEndpoint{}
+	err := db.View(func(tx *DBStructure) error {
+		found, exists := tx.WebhookEndpoints[id]
+		if !exists {
+			return ErrNotFound
+		}
+		endpoint = found
+		return nil
+	})
+	return endpoint, err
+}
+
+// DeleteWebhookEndpoint removes an endpoint along with its deliveries
+func (db *DB) DeleteWebhookEndpoint(id int) error {
+	return db.Update(func(tx *DBStructure) error {
+		if _, exists := tx.WebhookEndpoints[id]; !exists {
+			return ErrNotFound
+		}
+		tx.remove("webhook_endpoints", id)
+		for deliveryId, delivery := range tx.WebhookDeliveries {
+			if delivery.EndpointId == id {
+				tx.remove("webhook_deliveries", deliveryId)
+			}
+		}
+		return nil
+	})
+}
+
+// EnqueueWebhookDeliveries queues payload for every endpoint that
+// subscribed to event and gets the events of userId, returning how
+// many deliveries were queued
+func (db *DB) EnqueueWebhookDeliveries(event string, userId int, payload []byte) (int, error) {
+	queued := 0
+	err := db.Update(func(tx *DBStructure) error {
+		now := time.Now().UTC()
+		for _, endpoint := range tx.WebhookEndpoints {
+			if !endpoint.receives(event, userId, tx.Users[endpoint.UserId].Role) {
+				continue
+			}
+			delivery := WebhookDelivery{
+				Id:            tx.nextId("webhook_deliveries"),
+				EndpointId:    endpoint.Id,
+				Event:         event,
+				Payload:       append([]byte(nil), payload...),
+				Status:        "pending",
+				NextAttemptAt: now,
+				CreatedAt:     now,
+			}
+			tx.put("webhook_deliveries", delivery.Id, delivery)
+			queued++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return queued, nil
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries whose
+// next attempt is due at now, oldest first
+func (db *DB) DueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	due := []WebhookDelivery{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, delivery := range tx.WebhookDeliveries {
+			if delivery.Status == "pending" && !delivery.NextAttemptAt.After(now) {
+				due = append(due, delivery)
+			}
+		}
+		return nil
+	})
+	sort.Slice(due, func(i, j int) bool { return due[i].Id < due[j].Id })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, err
+}
+
+// SaveWebhookDelivery records the outcome of an attempt
+func (db *DB) SaveWebhookDelivery(delivery WebhookDelivery) error {
+	return db.Update(func(tx *DBStructure) error {
+		if _, exists := tx.WebhookDeliveries[delivery.Id]; !exists {
+			return ErrNotFound
+		}
+		tx.put("webhook_deliveries", delivery.Id, delivery)
+		return nil
+	})
+}
+
+// GetWebhookDeliveries lists the deliveries to an endpoint, or to all
+// of them when endpointId is 0, with the given status or any when it
+// is empty, newest first
+func (db *DB) GetWebhookDeliveries(endpointId int, status string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, delivery := range tx.WebhookDeliveries {
+			if (endpointId == 0 || delivery.EndpointId == endpointId) && (status == "" || delivery.Status == status) {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		return nil
+	})
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Id > deliveries[j].Id })
+	return deliveries, err
+}
+
+func (db *DB) GetWebhookDelivery(id int) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	err := db.View(func(tx *DBStructure) error {
+		found, exists := tx.WebhookDeliveries[id]
+		if !exists {
+			return ErrNotFound
+		}
+		delivery = found
+		return nil
+	})
+	return delivery, err
+}
+
+// PurgeDeliveredWebhooks deletes deliveries that succeeded before
+// deliveredBefore, dead ones are kept for the dead letter list
+func (db *DB) PurgeDeliveredWebhooks(deliveredBefore time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *DBStructure) error {
+		for id, delivery := range tx.WebhookDeliveries {
+			if delivery.Status == "delivered" && delivery.DeliveredAt != nil && delivery.DeliveredAt.Before(deliveredBefore) {
+				tx.remove("webhook_deliveries", id)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Entitlements are what the users of a plan can do
+type Entitlements struct {
+	MaxChirpLength int  `json:"max_chirp_length"`
+	CanEdit        bool `json:"can_edit"`
+	ChirpsPerHour  int  `json:"chirps_per_hour"` // 0 is unlimited
+
+	// MaxAttachments is reserved for when chirps can have attachments,
+	// it is reported but nothing enforces it yet
+	MaxAttachments int `json:"max_attachments"`
+}
+
+// defaultPlans are used for the plans the plan file leaves out
+var defaultPlans = map[string]Entitlements{
+	planFree:      {MaxChirpLength: 140, CanEdit: true, MaxAttachments: 0, ChirpsPerHour: 0},
+	planChirpyRed: {MaxChirpLength: 280, CanEdit: true, MaxAttachments: 4, ChirpsPerHour: 0},
+}
+
+// plans is the entitlements of each plan, by plan name
+var plans map[string]Entitlements
+
+// loadPlans reads the plan table at path, a JSON object of
+// entitlements by plan name, on top of defaultPlans
+func loadPlans(path string) (map[string]Entitlements, error) {
+	loaded := map[string]Entitlements{}
+	for plan, entitlements := range defaultPlans {
+		loaded[plan] = entitlements
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return loaded, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	fromFile := map[string]Entitlements{}
+	err = json.Unmarshal(data, &fromFile)
+	if err != nil {
+		return nil, err
+	}
+	for plan, entitlements := range fromFile {
+		if _, known := defaultPlans[plan]; !known {
+			return nil, fmt.Errorf("unknown plan %q", plan)
+		}
+		if entitlements.MaxChirpLength <= 0 || entitlements.MaxAttachments < 0 || entitlements.ChirpsPerHour < 0 {
+			return nil, fmt.Errorf("%s: max_chirp_length must be positive, max_attachments and chirps_per_hour not negative", plan)
+		}
+		loaded[plan] = entitlements
+	}
+	return loaded, nil
+}
+
+// entitlementsFor looks up what a user on plan can do
+func entitlementsFor(plan string) Entitlements {
+	entitlements, ok := plans[plan]
+	if !ok {
+		return plans[planFree]
+	}
+	return entitlements
+}
+
+// entitlementsOf looks up what the plan of a user lets them do
+func (cfg *apiConfig) entitlementsOf(userId int) (Entitlements, error) {
+	user, err := cfg.DB.GetUserById(userId)
+	if err != nil {
+		return Entitlements{}, err
+	}
+	return entitlementsFor(user.Subscription.Plan), nil
+}
+
+// handlerEntitlements tells users what their plan lets them do
+func (cfg *apiConfig) handlerEntitlements(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(principal.UserId)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+
+	payload := struct {
+		Plan string `json:"plan"`
+		Entitlements
+	}{
+		Plan:         user.Subscription.Plan,
+		Entitlements: entitlementsFor(user.Subscription.Plan),
+	}
+	w = respondWithJSON(w, 200, payload)
+}
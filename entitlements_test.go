@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateChirpRateLimit(t *testing.T) {
+	profanity = newTestWordFilter(t, nil, "fixed")
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			steps := []struct {
+				authorId int
+				perHour  int
+				wantErr  error
+			}{
+				{1, 2, nil},
+				{1, 2, nil},
+				{1, 2, ErrRateLimited},
+				{2, 2, nil},
+				{1, 3, nil},
+				{1, 0, nil},
+			}
+			for _, email := range []string{"alice@example.com", "bob@example.com"} {
+				_, err := store.CreateUser(email, "hash")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, step := range steps {
+				_, err := store.CreateChirp("hello", step.authorId, step.perHour)
+				if !errors.Is(err, step.wantErr) {
+					t.Errorf("step %d: CreateChirp() error = %v, want %v", i, err, step.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateChirpRateLimitWindow(t *testing.T) {
+	profanity = newTestWordFilter(t, nil, "fixed")
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := db.CreateUser("alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two chirps from before the last hour with a purged one between
+	// them, then one from within it
+	now := time.Now().UTC()
+	for i, createdAt := range []time.Time{now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Minute)} {
+		chirp, err := db.CreateChirp("hello", alice.Id, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Update(func(tx *DBStructure) error {
+			if i == 2 {
+				tx.remove("chirps", chirp.Id)
+				return nil
+			}
+			chirp.CreatedAt = createdAt
+			tx.put("chirps", chirp.Id, chirp)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.CreateChirp("hello", alice.Id, 2)
+	if err != nil {
+		t.Fatalf("second chirp of the hour: %v", err)
+	}
+	_, err = db.CreateChirp("hello", alice.Id, 2)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("third chirp of the hour: error = %v, want ErrRateLimited", err)
+	}
+}
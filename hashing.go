@@ -1,9 +1,18 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
+// sha256Hex is the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func hash(clear_password string) (string, error) {
 	hashed_password, err := bcrypt.GenerateFromPassword([]byte(clear_password), 10)
 	if err != nil {
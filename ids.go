@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+)
+
+// publicIdFormat picks the kind of id chirps and users are exposed
+// under next to their numeric id: "" (none), "uuid" or "ulid".
+// The numeric ids stay the primary keys either way.
+var publicIdFormat = ""
+
+func validPublicIdFormat(format string) error {
+	switch format {
+	case "", "uuid", "ulid":
+		return nil
+	default:
+		return fmt.Errorf("unknown public id format %q", format)
+	}
+}
+
+// newPublicId returns a fresh public id, or "" when they are turned off
+func newPublicId() string {
+	return newPublicIdAt(time.Now())
+}
+
+// newPublicIdAt returns a public id for a record created at createdAt,
+// so ULIDs of backfilled records sort in creation order
+func newPublicIdAt(createdAt time.Time) string {
+	switch publicIdFormat {
+	case "uuid":
+		return uuid.NewString()
+	case "ulid":
+		return ulid.MustNew(ulid.Timestamp(createdAt), rand.Reader).String()
+	default:
+		return ""
+	}
+}
+
+// sequenced are the tables nextId hands out ids for, with how to find
+// the highest id in use in each. Sessions are keyed by token hash, so
+// their ids are only in the records.
+var sequenced = map[string]func(dbStructure *DBStructure) int{
+	"chirps":             func(dbStructure *DBStructure) int { return highestKey(dbStructure.Chirps) },
+	"users":              func(dbStructure *DBStructure) int { return highestKey(dbStructure.Users) },
+	"reports":            func(dbStructure *DBStructure) int { return highestKey(dbStructure.Reports) },
+	"webhook_events":     func(dbStructure *DBStructure) int { return highestKey(dbStructure.WebhookEvents) },
+	"webhook_endpoints":  func(dbStructure *DBStructure) int { return highestKey(dbStructure.WebhookEndpoints) },
+	"webhook_deliveries": func(dbStructure *DBStructure) int { return highestKey(dbStructure.WebhookDeliveries) },
+	"sessions": func(dbStructure *DBStructure) int {
+		highest := 0
+		for _, session := range dbStructure.Sessions {
+			highest = max(highest, session.Id)
+		}
+		return highest
+	},
+}
+
+// highestKey is the highest id in use in a table keyed by id
+func highestKey[V any](table map[int]V) int {
+	highest := 0
+	for id := range table {
+		highest = max(highest, id)
+	}
+	return highest
+}
+
+// nextId bumps and returns the sequence for table. Sequences only
+// ever go up, so an id is never handed out twice even after deletes.
+// Databases written before sequences existed start from the highest
+// id in use.
+func (dbStructure *DBStructure) nextId(table string) int {
+	highestId, ok := sequenced[table]
+	if !ok {
+		panic(fmt.Sprintf("table %q has no sequence", table))
+	}
+	seq, exists := dbStructure.Sequences[table]
+	if !exists {
+		seq = highestId(dbStructure)
+	}
+
+	seq++
+	dbStructure.put("sequences", table, seq)
+	return seq
+}
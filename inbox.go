@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// RecordWebhookEvent puts a webhook in the inbox. If an event with the
+// same id from the same source is already there it is returned
+// instead, with created false.
+func (db *DB) RecordWebhookEvent(source string, eventId string, event string, payload []byte) (WebhookEvent, bool, error) {
+	recorded := WebhookEvent{}
+	created := false
+	err := db.Update(func(tx *DBStructure) error {
+		for _, existing := range tx.WebhookEvents {
+			if existing.Source == source && existing.EventId == eventId {
+				recorded = existing
+				return nil
+			}
+		}
+
+		recorded = WebhookEvent{
+			Id:         tx.nextId("webhook_events"),
+			Source:     source,
+			EventId:    eventId,
+			Event:      event,
+			Payload:    append([]byte(nil), payload...),
+			Status:     "received",
+			ReceivedAt: time.Now().UTC(),
+		}
+		tx.put("webhook_events", recorded.Id, recorded)
+		created = true
+		return nil
+	})
+	return recorded, created, err
+}
+
+// FinishWebhookEvent records the outcome of an attempt at processing
+// an event, errMsg is why it failed
+func (db *DB) FinishWebhookEvent(id int, status string, errMsg string) (WebhookEvent, error) {
+	finished := WebhookEvent{}
+	err := db.Update(func(tx *DBStructure) error {
+		event, exists := tx.WebhookEvents[id]
+		if !exists {
+			return ErrNotFound
+		}
+
+		now := time.Now().UTC()
+		event.Status = status
+		event.Error = errMsg
+		event.Attempts++
+		event.ProcessedAt = &now
+		tx.put("webhook_events", id, event)
+		finished = event
+		return nil
+	})
+	return finished, err
+}
+
+// GetWebhookEvents lists the events in the inbox with the given
+// status, or all of them when status is empty, oldest first
+func (db *DB) GetWebhookEvents(status string) ([]WebhookEvent, error) {
+	events := []WebhookEvent{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, event := range tx.WebhookEvents {
+			if status == "" || event.Status == status {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	sort.Slice(events, func(i, j int) bool { return events[i].Id < events[j].Id })
+	return events, err
+}
+
+func (db *DB) GetWebhookEvent(id int) (WebhookEvent, error) {
+	event := WebhookEvent{}
+	err := db.View(func(tx *DBStructure) error {
+		found, exists := tx.WebhookEvents[id]
+		if !exists {
+			return ErrNotFound
+		}
+		event = found
+		return nil
+	})
+	return event, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// startJob runs fn in the background every interval until the
+// process exits. Failures are logged and retried on the next tick.
+func startJob(name string, interval time.Duration, fn func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := fn()
+			if err != nil {
+				log.Printf("%s: %v", name, err)
+			}
+		}
+	}()
+}
+
+// purgeDeletedChirps hard-deletes chirps that were soft deleted
+// longer ago than the retention period
+func (cfg *apiConfig) purgeDeletedChirps() error {
+	purged, err := cfg.DB.PurgeDeletedChirps(time.Now().UTC().Add(-cfg.config.ChirpRetention))
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		log.Printf("purged %d deleted chirps", purged)
+	}
+	return nil
+}
+
+// purgeExpiredSessions deletes sessions whose refresh token has expired
+func (cfg *apiConfig) purgeExpiredSessions() error {
+	purged, err := cfg.DB.PurgeExpiredSessions(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		log.Printf("purged %d expired sessions", purged)
+	}
+	return nil
+}
+
+// purgeRevokedTokens empties the denylist of access tokens that have expired
+func (cfg *apiConfig) purgeRevokedTokens() error {
+	purged, err := cfg.DB.PurgeRevokedTokens(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		log.Printf("purged %d revoked tokens", purged)
+	}
+	return nil
+}
+
+// purgeDeliveredWebhooks deletes outbound webhooks delivered longer
+// ago than the retention
+func (cfg *apiConfig) purgeDeliveredWebhooks() error {
+	purged, err := cfg.DB.PurgeDeliveredWebhooks(time.Now().UTC().Add(-cfg.config.DeliveryRetention))
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		log.Printf("purged %d delivered webhooks", purged)
+	}
+	return nil
+}
+
+// expireSubscriptions takes users whose subscription lapsed off Chirpy Red
+func (cfg *apiConfig) expireSubscriptions() error {
+	expired, err := cfg.DB.ExpireSubscriptions(time.Now().UTC(), cfg.config.SubscriptionGrace)
+	if err != nil {
+		return err
+	}
+	if expired > 0 {
+		log.Printf("expired %d subscriptions", expired)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is one key tokens can be signed or verified with.
+// Keys loaded from a public key file have no signKey and only verify.
+type jwtKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeyManager holds every key an access token may have been signed
+// with, by kid, and the one new tokens are signed with. Rotating means
+// adding a key, making it the signing key, and removing the old one
+// once the tokens it signed have expired.
+type KeyManager struct {
+	keys     map[string]jwtKey
+	signing  jwtKey
+	issuer   string
+	audience string
+}
+
+// keys is the key manager used by createJWT and parseJWT
+var keys *KeyManager
+
+// loadKeys builds the key manager from the HS256 secret (kid
+// "default"), if there is one, and the key files in dir:
+// <kid>.secret for HS256, <kid>.pem with an RSA (RS256) or Ed25519
+// (EdDSA) private key, or <kid>.pub.pem with a public key that only
+// verifies. signingKid picks the signing key, it can be left empty
+// when there is a single signing key.
+func loadKeys(secret string, dir string, signingKid string, issuer string, audience string) (*KeyManager, error) {
+	km := &KeyManager{
+		keys:     map[string]jwtKey{},
+		issuer:   issuer,
+		audience: audience,
+	}
+
+	if secret != "" {
+		km.keys["default"] = jwtKey{
+			kid:       "default",
+			method:    jwt.SigningMethodHS256,
+			signKey:   []byte(secret),
+			verifyKey: []byte(secret),
+		}
+	}
+
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			key, ok, err := readKeyFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+			if !ok {
+				continue
+			}
+			if _, exists := km.keys[key.kid]; exists {
+				return nil, fmt.Errorf("duplicate key id %q", key.kid)
+			}
+			km.keys[key.kid] = key
+		}
+	}
+
+	if signingKid == "" {
+		for kid, key := range km.keys {
+			if key.signKey == nil {
+				continue
+			}
+			if signingKid != "" {
+				return nil, fmt.Errorf("there are several signing keys, pick one with --jwt-signing-key")
+			}
+			signingKid = kid
+		}
+	}
+	if signingKid == "" {
+		return nil, fmt.Errorf("no key to sign tokens with, set JWT_SECRET or --jwt-keys")
+	}
+
+	signing, exists := km.keys[signingKid]
+	if !exists || signing.signKey == nil {
+		return nil, fmt.Errorf("no private key or secret with id %q", signingKid)
+	}
+	km.signing = signing
+	return km, nil
+}
+
+// readKeyFile loads a key named after its file,
+// ok is false for files that aren't keys
+func readKeyFile(path string) (key jwtKey, ok bool, err error) {
+	name := filepath.Base(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return jwtKey{}, false, err
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".secret"):
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return jwtKey{}, false, fmt.Errorf("empty secret")
+		}
+		return jwtKey{
+			kid:       strings.TrimSuffix(name, ".secret"),
+			method:    jwt.SigningMethodHS256,
+			signKey:   []byte(secret),
+			verifyKey: []byte(secret),
+		}, true, nil
+
+	case strings.HasSuffix(name, ".pub.pem"):
+		key = jwtKey{kid: strings.TrimSuffix(name, ".pub.pem")}
+		if public, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+			key.method, key.verifyKey = jwt.SigningMethodRS256, public
+		} else if public, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+			key.method, key.verifyKey = jwt.SigningMethodEdDSA, public
+		} else {
+			return jwtKey{}, false, fmt.Errorf("not an RSA or Ed25519 public key")
+		}
+		return key, true, nil
+
+	case strings.HasSuffix(name, ".pem"):
+		key = jwtKey{kid: strings.TrimSuffix(name, ".pem")}
+		if private, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+			key.method, key.signKey, key.verifyKey = jwt.SigningMethodRS256, private, &private.PublicKey
+		} else if private, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+			key.method, key.signKey, key.verifyKey = jwt.SigningMethodEdDSA, private, private.(ed25519.PrivateKey).Public()
+		} else {
+			return jwtKey{}, false, fmt.Errorf("not an RSA or Ed25519 private key")
+		}
+		return key, true, nil
+	}
+	return jwtKey{}, false, nil
+}
+
+// Sign signs claims with the signing key, setting the issuer,
+// audience and kid that Parse insists on
+func (km *KeyManager) Sign(claims *chirpyClaims) (string, error) {
+	claims.Issuer = km.issuer
+	claims.Audience = jwt.ClaimStrings{km.audience}
+
+	token := jwt.NewWithClaims(km.signing.method, claims)
+	token.Header["kid"] = km.signing.kid
+	return token.SignedString(km.signing.signKey)
+}
+
+// Parse verifies a token with the key named by its kid. The token
+// must use that key's algorithm, come from our issuer, be meant for
+// our audience and not be expired.
+func (km *KeyManager) Parse(tokenString string) (*chirpyClaims, error) {
+	methods := []string{}
+	for _, key := range km.keys {
+		methods = append(methods, key.method.Alg())
+	}
+
+	claims := &chirpyClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, exists := km.keys[kid]
+		if !exists {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("key %q is not for %s", kid, token.Method.Alg())
+		}
+		return key.verifyKey, nil
+	},
+		jwt.WithValidMethods(methods),
+		jwt.WithIssuer(km.issuer),
+		jwt.WithAudience(km.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// jwk is a public key in the JSON Web Key format of RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public half of the asymmetric keys,
+// HS256 secrets are never published
+func (km *KeyManager) JWKS() []jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	set := []jwk{}
+	for _, key := range km.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set = append(set, jwk{
+				Kty: "RSA",
+				Kid: key.kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				N:   b64(public.N.Bytes()),
+				E:   b64(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set = append(set, jwk{
+				Kty: "OKP",
+				Kid: key.kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				Crv: "Ed25519",
+				X:   b64(public),
+			})
+		}
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i].Kid < set[j].Kid })
+	return set
+}
+
+func handlerJWKS(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, map[string][]jwk{"keys": keys.JWKS()})
+}
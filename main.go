@@ -4,22 +4,25 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"unicode"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type apiConfig struct {
 	fileserverHits int
-	DB             DB
+	DB             Store
+	config         Config
 }
 
 func handler(w http.ResponseWriter, req *http.Request) {
@@ -73,6 +76,47 @@ func (cfg *apiConfig) handlerAdmin(w http.ResponseWriter, req *http.Request) {
 </html>`, cfg.fileserverHits)))
 }
 
+// handlerWordList shows the moderation word list and adds words to it
+func (cfg *apiConfig) handlerWordList(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		w = respondWithJSON(w, 200, map[string][]string{"words": profanity.Words()})
+
+	} else if req.Method == http.MethodPost {
+		type parameters struct {
+			Words []string `json:"words"`
+		}
+
+		decoder := json.NewDecoder(req.Body)
+		params := parameters{}
+		err := decoder.Decode(&params)
+		if err != nil || len(params.Words) == 0 {
+			w = respondWithError(w, 400, "words must be a non-empty list")
+			return
+		}
+
+		words, err := profanity.AddWords(params.Words)
+		if err != nil {
+			w = respondWithError(w, 500, "Something went wrong saving the word list")
+			return
+		}
+		w = respondWithJSON(w, 200, map[string][]string{"words": words})
+
+	} else if req.Method == http.MethodDelete {
+		err := profanity.RemoveWord(req.PathValue("word"))
+		if errors.Is(err, ErrNotFound) {
+			w = respondWithError(w, 404, "Word is not in the list")
+			return
+		} else if err != nil {
+			w = respondWithError(w, 500, "Something went wrong saving the word list")
+			return
+		}
+		w.WriteHeader(204)
+
+	} else {
+		w = respondWithError(w, 405, "Method not allowed")
+	}
+}
+
 func respondWithError(w http.ResponseWriter, code int, msg string) http.ResponseWriter {
 	w.WriteHeader(code)
 	errResp := struct {
@@ -95,39 +139,28 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) http.
 	return w
 }
 
-var badWords = []string{
-	"kerfuffle",
-	"sharbert",
-	"fornax",
-}
+const maxReasonLength = 140
 
-func cleanBody(s string) string {
-	for _, badWord := range badWords {
-		s = strings.ReplaceAll(s, badWord, "****")
-		s = strings.ReplaceAll(s, capitalizeFirstLetter(badWord), "****")
+// profanity is the moderation word list every chirp goes through
+var profanity *WordFilter
 
-	}
-	return s
-}
-func capitalizeFirstLetter(s string) string {
-	if len(s) == 0 {
-		return s
-	}
-	runes := []rune(s)
-	runes[0] = unicode.ToUpper(runes[0])
-	return string(runes)
+func cleanBody(s string) string {
+	return profanity.Clean(s)
 }
 
 func (cfg *apiConfig) handlerChirp(w http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodPost {
-		subject, w := authenticateUser(w, req)
-
-		if subject == "" {
+		principal, ok := principalFrom(req.Context())
+		if !ok {
+			respondUnauthorized(w, "", "No Authorization Token")
 			return
 		}
-		userId, err := strconv.Atoi(subject)
+		userId := principal.UserId
+
+		entitlements, err := cfg.entitlementsOf(userId)
 		if err != nil {
-			w = respondWithError(w, 500, err.Error())
+			w = respondWithError(w, 500, "Something went wrong")
+			return
 		}
 
 		type parameters struct {
@@ -142,106 +175,324 @@ func (cfg *apiConfig) handlerChirp(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if len(params.Body) > 140 {
+		if len(params.Body) > entitlements.MaxChirpLength {
 			w = respondWithError(w, 400, "Chirp is too long")
 			return
 		} else {
 			cleanedBody := cleanBody(params.Body)
-			chirp, err := cfg.DB.CreateChirp(cleanedBody, userId)
-			if err != nil {
+			chirp, err := cfg.DB.CreateChirp(cleanedBody, userId, entitlements.ChirpsPerHour)
+			if errors.Is(err, ErrRateLimited) {
+				w = respondWithError(w, 429, fmt.Sprintf("Your plan allows %d chirps per hour", entitlements.ChirpsPerHour))
+				return
+			} else if err != nil {
 				w = respondWithError(w, 500, "Something went wrong making chirps")
 				return
 			}
+			cfg.emit("chirp.created", userId, chirp)
 			w = respondWithJSON(w, 201, chirp)
 		}
 	} else if req.Method == http.MethodGet {
-		s := req.URL.Query().Get("author_id")
-		if s == "" {
-			chirpId, err := strconv.Atoi(req.PathValue("chirpId"))
+		idParam := req.PathValue("chirpId")
+		if idParam == "" {
+			q, paginated, err := parseChirpQuery(req)
 			if err != nil {
-				chirps, _ := cfg.DB.GetChirps()
-				w = respondWithJSON(w, 200, chirps)
+				w = respondWithError(w, 400, err.Error())
 				return
 			}
 
-			chirp, err := cfg.DB.GetChirp(chirpId)
+			chirps, nextCursor, err := cfg.DB.GetChirps(q)
 			if err != nil {
-				w = respondWithError(w, 404, "Chirp Id does not exist")
+				w = respondWithError(w, 500, "Something went wrong")
+				return
+			}
+			if paginated {
+				respondWithPage(w, req, chirps, nextCursor)
+				return
 			}
-			w = respondWithJSON(w, 200, chirp)
+			w = respondWithJSON(w, 200, chirps)
+			return
+		}
 
+		var chirp Chirp
+		chirpId, err := strconv.Atoi(idParam)
+		if err == nil {
+			chirp, err = cfg.DB.GetChirp(chirpId)
 		} else {
-			authorId, err := strconv.Atoi(s)
-			if err != nil {
-				w.WriteHeader(500)
-			}
-			sortMethod := req.URL.Query().Get("sort")
-			if sortMethod == "" {
-				sortMethod == "asc"
-			}
+			chirp, err = cfg.DB.GetChirpByPublicId(idParam)
+		}
+		if err != nil {
+			w = respondWithError(w, 404, "Chirp Id does not exist")
+			return
+		}
+		w = respondWithJSON(w, 200, chirp)
 
-			chirps, _ := cfg.DB.GetUserChirps(authorId, sortMethod)
+	} else if req.Method == http.MethodDelete {
+		principal, ok := principalFrom(req.Context())
+		if !ok {
+			respondUnauthorized(w, "", "No Authorization Token")
+			return
+		}
+		userId := principal.UserId
+
+		chirpId, err := strconv.Atoi(req.PathValue("chirpId"))
+		if err != nil {
+			chirps, _, _ := cfg.DB.GetChirps(ChirpQuery{})
 			w = respondWithJSON(w, 200, chirps)
 			return
+		}
 
+		err = cfg.DB.DeleteChirp(chirpId, userId)
+		if errors.Is(err, ErrNotFound) {
+			w = respondWithError(w, 404, "Chirp Id does not exist")
+			return
+		} else if err != nil {
+			w = respondWithError(w, 403, err.Error())
+			return
 		}
+		cfg.emit("chirp.deleted", userId, map[string]int{"id": chirpId, "author_id": userId})
 
-	} else if req.Method == http.MethodDelete {
-		subject, w := authenticateUser(w, req)
+		w.WriteHeader(204)
 
-		if subject == "" {
-			w.WriteHeader(204)
+	} else if req.Method == http.MethodPut {
+		principal, ok := principalFrom(req.Context())
+		if !ok {
+			respondUnauthorized(w, "", "No Authorization Token")
 			return
 		}
+		userId := principal.UserId
 
-		userId, err := strconv.Atoi(subject)
+		entitlements, err := cfg.entitlementsOf(userId)
 		if err != nil {
-			w = respondWithError(w, 500, err.Error())
+			w = respondWithError(w, 500, "Something went wrong")
+			return
+		}
+		if !entitlements.CanEdit {
+			w = respondWithError(w, 403, "Your plan does not allow editing chirps")
+			return
 		}
 
 		chirpId, err := strconv.Atoi(req.PathValue("chirpId"))
 		if err != nil {
-			chirps, _ := cfg.DB.GetChirps()
-			w = respondWithJSON(w, 200, chirps)
+			w = respondWithError(w, 404, "Chirp Id does not exist")
 			return
 		}
 
-		err = cfg.DB.DeleteChirp(chirpId, userId)
+		type parameters struct {
+			Body string `json:"body"`
+		}
+
+		decoder := json.NewDecoder(req.Body)
+		params := parameters{}
+		err = decoder.Decode(&params)
 		if err != nil {
+			w = respondWithError(w, 400, "Something went wrong")
+			return
+		}
+
+		if len(params.Body) > entitlements.MaxChirpLength {
+			w = respondWithError(w, 400, "Chirp is too long")
+			return
+		}
+
+		chirp, err := cfg.DB.EditChirp(chirpId, userId, cleanBody(params.Body))
+		if errors.Is(err, ErrNotFound) {
+			w = respondWithError(w, 404, "Chirp Id does not exist")
+			return
+		} else if errors.Is(err, ErrNotAuthorized) {
 			w = respondWithError(w, 403, err.Error())
+			return
+		} else if err != nil {
+			w = respondWithError(w, 500, "Something went wrong editing chirp")
+			return
 		}
+		cfg.emit("chirp.updated", userId, chirp)
+		w = respondWithJSON(w, 200, chirp)
 
-		w.WriteHeader(204)
+	}
+}
 
+// handlerChirpHistory lists the previous versions of an edited chirp, oldest first
+func (cfg *apiConfig) handlerChirpHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	chirpId, err := strconv.Atoi(req.PathValue("chirpId"))
+	if err != nil {
+		chirp, err := cfg.DB.GetChirpByPublicId(req.PathValue("chirpId"))
+		if err != nil {
+			w = respondWithError(w, 404, "Chirp Id does not exist")
+			return
+		}
+		chirpId = chirp.Id
+	}
+
+	history, err := cfg.DB.GetChirpHistory(chirpId)
+	if err != nil {
+		w = respondWithError(w, 404, "Chirp Id does not exist")
+		return
 	}
+	w = respondWithJSON(w, 200, history)
 }
 
-func authenticateUser(w http.ResponseWriter, req *http.Request) (string, http.ResponseWriter) {
+// handlerChirpRestore brings back a deleted chirp, only its author
+// can do it and only within the restore window
+func (cfg *apiConfig) handlerChirpRestore(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
 
-	tokenString := req.Header.Get("Authorization")
-	if tokenString == "" {
-		w = respondWithError(w, 500, "No Authorization Token")
-		return "", w
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
 	}
+	userId := principal.UserId
 
-	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
+	chirpId, err := strconv.Atoi(req.PathValue("chirpId"))
+	if err != nil {
+		w = respondWithError(w, 404, "Chirp Id does not exist")
+		return
+	}
 
-	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	chirp, err := cfg.DB.RestoreChirp(chirpId, userId, time.Now().UTC().Add(-cfg.config.RestoreWindow))
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Chirp Id does not exist")
+		return
+	} else if errors.Is(err, ErrNotAuthorized) {
+		w = respondWithError(w, 403, err.Error())
+		return
+	} else if errors.Is(err, ErrExpired) {
+		w = respondWithError(w, 410, err.Error())
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong restoring chirp")
+		return
+	}
+	w = respondWithJSON(w, 200, chirp)
+}
+
+// handlerChirpReport lets a user flag someone else's chirp for moderation
+func (cfg *apiConfig) handlerChirpReport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+	userId := principal.UserId
+
+	chirpId, err := strconv.Atoi(req.PathValue("chirpId"))
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", w
+		w = respondWithError(w, 404, "Chirp Id does not exist")
+		return
+	}
+	chirp, err := cfg.DB.GetChirp(chirpId)
+	if err != nil {
+		w = respondWithError(w, 404, "Chirp Id does not exist")
+		return
+	}
+	if chirp.AuthorId == userId {
+		w = respondWithError(w, 400, "You can't report your own chirp")
+		return
 	}
 
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
-	if !ok || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", w
+	type parameters struct {
+		Reason string `json:"reason"`
 	}
 
-	return claims.Subject, w
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w = respondWithError(w, 400, "Something went wrong")
+		return
+	}
+	if len(params.Reason) > maxReasonLength {
+		w = respondWithError(w, 400, "Reason is too long")
+		return
+	}
+
+	report, err := cfg.DB.ReportChirp(chirpId, userId, params.Reason, cfg.config.ReportThreshold)
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Chirp Id does not exist")
+		return
+	} else if errors.Is(err, ErrAlreadyReported) {
+		w = respondWithError(w, 409, "You already reported this chirp")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong reporting chirp")
+		return
+	}
+	w = respondWithJSON(w, 201, report)
+}
+
+// handlerReports is the moderation queue, open reports by default
+// or ?status=hidden, dismissed or all
+func (cfg *apiConfig) handlerReports(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	status := req.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = "open"
+	case "open", "hidden", "dismissed":
+	case "all":
+		status = ""
+	default:
+		w = respondWithError(w, 400, "status must be open, hidden, dismissed or all")
+		return
+	}
+
+	reports, err := cfg.DB.GetReports(status)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, reports)
+}
+
+// handlerReportAction hides the chirp of a report or dismisses it
+func (cfg *apiConfig) handlerReportAction(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	reportId, err := strconv.Atoi(req.PathValue("reportId"))
+	if err != nil {
+		w = respondWithError(w, 404, "Report does not exist")
+		return
+	}
+
+	var hide bool
+	switch req.PathValue("action") {
+	case "hide":
+		hide = true
+	case "dismiss":
+	default:
+		w = respondWithError(w, 404, "Unknown action")
+		return
+	}
+
+	report, err := cfg.DB.ResolveReport(reportId, hide)
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Report does not exist")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, report)
 }
 
 func (cfg *apiConfig) handlerUser(w http.ResponseWriter, req *http.Request) {
@@ -280,15 +531,12 @@ func (cfg *apiConfig) handlerUser(w http.ResponseWriter, req *http.Request) {
 		w = respondWithJSON(w, 201, user)
 
 	} else if req.Method == http.MethodPut {
-		subject, w := authenticateUser(w, req)
-		if subject == "" {
+		principal, ok := principalFrom(req.Context())
+		if !ok {
+			respondUnauthorized(w, "", "No Authorization Token")
 			return
 		}
-
-		userId, err := strconv.Atoi(subject)
-		if err != nil {
-			w = respondWithError(w, 500, err.Error())
-		}
+		userId := principal.UserId
 
 		type parameters struct {
 			Email    string `json:"email"`
@@ -297,7 +545,7 @@ func (cfg *apiConfig) handlerUser(w http.ResponseWriter, req *http.Request) {
 
 		decoder := json.NewDecoder(req.Body)
 		params := parameters{}
-		err = decoder.Decode(&params)
+		err := decoder.Decode(&params)
 		if err != nil {
 			w = respondWithError(w, 500, "Something went wrong")
 			return
@@ -319,6 +567,63 @@ func (cfg *apiConfig) handlerUser(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// handlerUserRole changes the role of a user, admins only
+func (cfg *apiConfig) handlerUserRole(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	userId, err := strconv.Atoi(req.PathValue("userId"))
+	if err != nil {
+		w = respondWithError(w, 404, "User does not exist")
+		return
+	}
+
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil || !validRole(params.Role) {
+		w = respondWithError(w, 400, "role must be user, moderator or admin")
+		return
+	}
+
+	user, err := cfg.DB.SetUserRole(userId, params.Role)
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "User does not exist")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, user)
+}
+
+// promoteAdmin gives the admin role to the user configured with
+// --admin-email, if they already signed up. Signing up with it later
+// does nothing until the next start, nobody checks the email is theirs.
+func (cfg *apiConfig) promoteAdmin() error {
+	if cfg.config.AdminEmail == "" {
+		return nil
+	}
+	user, err := cfg.DB.GetUserByEmail(cfg.config.AdminEmail)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("--admin-email %s has not signed up, nobody was made admin", cfg.config.AdminEmail)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if user.Role == roleAdmin {
+		return nil
+	}
+	_, err = cfg.DB.SetUserRole(user.Id, roleAdmin)
+	return err
+}
+
 func makeRefreshToken() (string, error) {
 	c := 128
 	b := make([]byte, c)
@@ -335,9 +640,10 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, req *http.Request) {
 	// helperPrintHeaders(req)
 	if req.Method == http.MethodPost {
 		type parameters struct {
-			Email    string `json:"email"`
-			Password string `json:"password"`
-			Expires  int    `json:"expires_in_seconds,omitempty"`
+			Email          string `json:"email"`
+			Password       string `json:"password"`
+			Expires        int    `json:"expires_in_seconds,omitempty"`
+			RefreshExpires int    `json:"refresh_expires_in_seconds,omitempty"`
 		}
 
 		decoder := json.NewDecoder(req.Body)
@@ -347,31 +653,50 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, req *http.Request) {
 			w = respondWithError(w, 500, "Something went wrong")
 			return
 		}
+		if params.Expires < 0 || params.RefreshExpires < 0 {
+			w = respondWithError(w, 400, "expires_in_seconds must not be negative")
+			return
+		}
 
 		user, err := cfg.DB.GetUserByEmail(params.Email)
-
 		if err != nil {
-			w = respondWithError(w, 500, "User not found")
+			w = respondWithError(w, 401, "Wrong credentials")
+			return
 		}
 		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.Password))
 		if err != nil {
-			w = respondWithJSON(w, 401, "Wrong credentials")
+			w = respondWithError(w, 401, "Wrong credentials")
+			return
 		}
 
-		token := createJWT(user)
+		ttl := tokenLifetime(params.Expires, cfg.config.AccessTTL, cfg.config.MaxAccessTTL)
+		token, expiresAt := createJWT(user, ttl)
 
 		refreshToken, err := makeRefreshToken()
 		if err != nil {
-			w = respondWithJSON(w, 401, err.Error())
+			w = respondWithError(w, 500, "Something went wrong")
+			return
+		}
+		refreshTTL := tokenLifetime(params.RefreshExpires, cfg.config.RefreshTTL, cfg.config.MaxRefreshTTL)
+		refreshExpiresAt := time.Now().Add(refreshTTL).UTC().Truncate(time.Second)
+		_, err = cfg.DB.CreateSession(user.Id, refreshToken, req.UserAgent(), clientIP(req), refreshExpiresAt)
+		if err != nil {
+			w = respondWithError(w, 500, "Something went wrong")
+			return
 		}
-		cfg.DB.AddRefreshTokenToUser(user, refreshToken)
 
 		userOut := UserOutLogin{
-			Email:        user.Email,
-			UserId:       user.Id,
-			IsChirpyRed:  user.IsChirpyRed,
-			Token:        token,
-			RefreshToken: refreshToken,
+			Email:            user.Email,
+			UserId:           user.Id,
+			PublicId:         user.PublicId,
+			IsChirpyRed:      user.IsChirpyRed,
+			Subscription:     user.Subscription,
+			Role:             user.Role,
+			Token:            token,
+			ExpiresAt:        expiresAt,
+			ExpiresIn:        int(ttl / time.Second),
+			RefreshToken:     refreshToken,
+			RefreshExpiresAt: refreshExpiresAt,
 		}
 		w = respondWithJSON(w, 200, userOut)
 
@@ -393,22 +718,34 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, req *http.Request) {
 
 		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
 
-		newToken, valid, err := cfg.DB.RefreshTokenValid(tokenString)
+		refreshToken, err := makeRefreshToken()
 		if err != nil {
-			w = respondWithError(w, 401, "Not  Authorized")
+			w = respondWithError(w, 500, "Something went wrong")
 			return
 		}
 
-		payload := map[string]interface{}{
-			"token": newToken,
+		user, session, err := cfg.DB.RotateRefreshToken(tokenString, refreshToken, cfg.config.RefreshGrace)
+		if errors.Is(err, ErrTokenReused) {
+			log.Printf("refresh token reused, revoked its session")
+			w = respondWithError(w, 401, "Refresh token was already used, the session has been revoked")
+			return
+		} else if errors.Is(err, ErrNotFound) {
+			w = respondWithError(w, 401, "Not Authorized")
+			return
+		} else if err != nil {
+			w = respondWithError(w, 500, "Something went wrong")
+			return
 		}
 
-		if valid {
-			w = respondWithJSON(w, 200, payload)
-		} else {
-			w = respondWithError(w, 401, "Fuck you")
-
+		newToken, expiresAt := createJWT(user, cfg.config.AccessTTL)
+		payload := map[string]interface{}{
+			"token":              newToken,
+			"expires_at":         expiresAt,
+			"expires_in":         int(cfg.config.AccessTTL / time.Second),
+			"refresh_token":      refreshToken,
+			"refresh_expires_at": session.ExpiresAt,
 		}
+		w = respondWithJSON(w, 200, payload)
 
 	} else {
 		w = respondWithJSON(w, 405, "Method not allowed")
@@ -444,54 +781,215 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// handlerSessions lists the devices the user is logged in on
+func (cfg *apiConfig) handlerSessions(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	sessions, err := cfg.DB.GetSessions(principal.UserId)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+
+	sessionsOut := []SessionOut{}
+	for _, session := range sessions {
+		sessionsOut = append(sessionsOut, toSessionOut(session))
+	}
+	w = respondWithJSON(w, 200, sessionsOut)
+}
+
+// handlerDeleteSession logs the user out of one device
+func (cfg *apiConfig) handlerDeleteSession(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	sessionId, err := strconv.Atoi(req.PathValue("sessionId"))
+	if err != nil {
+		w = respondWithError(w, 404, "Session does not exist")
+		return
+	}
+
+	err = cfg.DB.DeleteSession(principal.UserId, sessionId)
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Session does not exist")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handlerLogout revokes the access token the request is made with,
+// the refresh token is revoked with /api/revoke
+func (cfg *apiConfig) handlerLogout(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	err := cfg.DB.RevokeAccessToken(principal.TokenId, principal.UserId, principal.ExpiresAt)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handlerLogoutAll logs the user out everywhere, revoking every
+// access token issued to them so far and ending all their sessions
+func (cfg *apiConfig) handlerLogoutAll(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	err := cfg.DB.RevokeAllTokens(principal.UserId)
+	if errors.Is(err, ErrNotFound) {
+		respondUnauthorized(w, "invalid_token", "Token has been revoked")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// clientIP is the address the request came from, proxies aren't trusted
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// maxWebhookBody is as much of a webhook as is read to check its signature
+const maxWebhookBody = 1 << 20
+
 func (cfg *apiConfig) handlerWebhook(w http.ResponseWriter, req *http.Request) {
-	apiKeyString := req.Header.Get("Authorization")
-	if apiKeyString == "" {
-		w.WriteHeader(401)
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookBody))
+	if err != nil {
+		w.WriteHeader(413)
 		return
 	}
 
-	apiKeyString = strings.TrimPrefix(apiKeyString, "ApiKey ")
-	fmt.Println(apiKeyString)
-	key := string(os.Getenv("POLKA_KEY"))
-	if apiKeyString != key {
+	err = polka.Verify(req.Header, body, time.Now())
+	if err != nil {
+		log.Printf("rejected polka webhook: %v", err)
 		w.WriteHeader(401)
 		return
 	}
 
 	if req.Method == http.MethodPost {
-		type parameters struct {
-			Event string `json:"event"`
-			Data  struct {
-				UserId int `json:"user_id"`
-			} `json:"data"`
+		params := polkaEvent{}
+		err := json.Unmarshal(body, &params)
+		if err != nil {
+			w = respondWithError(w, 500, "Something went wrong")
+			return
 		}
 
-		decoder := json.NewDecoder(req.Body)
-		params := parameters{}
-		err := decoder.Decode(&params)
+		eventId := params.Id
+		if eventId == "" {
+			eventId = webhookEventKey(req.Header, body)
+		}
+		event, created, err := cfg.DB.RecordWebhookEvent("polka", eventId, params.Event, body)
 		if err != nil {
 			w = respondWithError(w, 500, "Something went wrong")
 			return
 		}
-
-		if params.Event != "user.upgraded" {
+		if !created && event.Status != "failed" {
 			w.WriteHeader(204)
 			return
 		}
 
-		_, err = cfg.DB.GetUserById(params.Data.UserId)
-		if err != nil {
+		_, err = cfg.processWebhookEvent(event)
+		if errors.Is(err, ErrNotFound) {
 			w.WriteHeader(404)
 			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			return
 		}
-
-		cfg.DB.UpgradeUser(params.Data.UserId)
 		w.WriteHeader(204)
 
 	}
 }
 
+// handlerWebhookEvents lists the webhook inbox, failed events by
+// default or ?status=received, processed, ignored or all
+func (cfg *apiConfig) handlerWebhookEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	status := req.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = "failed"
+	case "received", "processed", "ignored", "failed":
+	case "all":
+		status = ""
+	default:
+		w = respondWithError(w, 400, "status must be received, processed, ignored, failed or all")
+		return
+	}
+
+	events, err := cfg.DB.GetWebhookEvents(status)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, events)
+}
+
+// handlerWebhookReplay processes a failed webhook event again, once
+// whatever made it fail has been fixed. Events stuck as received, by
+// a crash while processing them, can be replayed too.
+func (cfg *apiConfig) handlerWebhookReplay(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	id, err := strconv.Atoi(req.PathValue("eventId"))
+	if err != nil {
+		w = respondWithError(w, 404, "Webhook event does not exist")
+		return
+	}
+	event, err := cfg.DB.GetWebhookEvent(id)
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Webhook event does not exist")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	if event.Status != "failed" && event.Status != "received" {
+		w = respondWithError(w, 409, "Only failed or unprocessed events can be replayed")
+		return
+	}
+
+	// failing again is still a result, only not being able
+	// to record the outcome is an error
+	replayed, err := cfg.processWebhookEvent(event)
+	if err != nil && replayed.Id == 0 {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, replayed)
+}
+
 func helperPrintHeaders(req *http.Request) {
 	// Print the method and endpoint
 	fmt.Printf("===========")
@@ -511,31 +1009,103 @@ func main() {
 	godotenv.Load()
 	serverMux := http.NewServeMux()
 
-	err := os.Remove("database.json")
-	if err != nil && !os.IsNotExist(err) {
-		log.Printf("Failed to delete existing database file: %v", err)
-	} else {
-		log.Println("Existing database file deleted or not found.")
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
-	db_, _ := NewDB("database.json")
+	publicIdFormat = config.PublicIdFormat
+
+	keys, err = loadKeys(os.Getenv("JWT_SECRET"), config.JWTKeysDir, config.JWTSigningKey, config.JWTIssuer, config.JWTAudience)
+	if err != nil {
+		log.Fatalf("Failed to load token keys: %v", err)
+	}
+
+	plans, err = loadPlans(config.PlansPath)
+	if err != nil {
+		log.Fatalf("Failed to load plans: %v", err)
+	}
+
+	polka = newWebhookVerifier(config.PolkaKeys, config.WebhookTolerance, config.PolkaApiKey)
+	if len(config.PolkaKeys) > 0 && !config.PolkaApiKey {
+		log.Printf("WARNING: polka webhooks must be signed, ones with an Authorization: ApiKey header are rejected. " +
+			"If Polka doesn't sign them yet start with --polka-api-key until it does, or Chirpy Red upgrades are lost.")
+	}
+	allowPrivateWebhooks = config.WebhookPrivate
+
+	profanity, err = loadWordFilter(config.WordListPath, config.MaskStyle)
+	if err != nil {
+		log.Fatalf("Failed to load word list: %v", err)
+	}
+
+	if config.ResetDB {
+		err = RemoveStore(config.DBDriver, config.DBPath)
+		if err != nil {
+			log.Fatalf("Failed to delete existing database file: %v", err)
+		}
+		log.Printf("Reset database %s", config.DBPath)
+	}
+	db_, err := OpenStore(config.DBDriver, config.DBPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db_.Close()
+
 	apiCfg := apiConfig{
 		fileserverHits: 0,
-		DB:             *db_,
+		DB:             db_,
+		config:         config,
 	}
 
+	err = apiCfg.promoteAdmin()
+	if err != nil {
+		log.Fatalf("Failed to promote admin: %v", err)
+	}
+
+	startJob("purge deleted chirps", config.PurgeInterval, apiCfg.purgeDeletedChirps)
+	startJob("purge expired sessions", config.PurgeInterval, apiCfg.purgeExpiredSessions)
+	startJob("purge revoked tokens", config.PurgeInterval, apiCfg.purgeRevokedTokens)
+	startJob("purge delivered webhooks", config.PurgeInterval, apiCfg.purgeDeliveredWebhooks)
+	startJob("expire subscriptions", config.PurgeInterval, apiCfg.expireSubscriptions)
+	startJob("deliver webhooks", config.DeliveryInterval, apiCfg.deliverWebhooks)
+
 	serverMux.Handle("/app/*", http.StripPrefix("/app", apiCfg.middlewareMetricsInc(http.FileServer(http.Dir(".")))))
 	serverMux.Handle("/assets", http.FileServer(http.Dir("assets/")))
 	serverMux.HandleFunc("/api/healthz", handler)
+	serverMux.HandleFunc("/.well-known/jwks.json", handlerJWKS)
 	serverMux.HandleFunc("/api/metrics", apiCfg.handlerHits)
-	serverMux.HandleFunc("/admin/metrics", apiCfg.handlerAdmin)
-	serverMux.HandleFunc("/api/reset", apiCfg.handlerResets)
-	serverMux.HandleFunc("/api/chirps", apiCfg.handlerChirp)
-	serverMux.HandleFunc("/api/chirps/{chirpId}", apiCfg.handlerChirp)
-	serverMux.HandleFunc("/api/users", apiCfg.handlerUser)
+	serverMux.Handle("/admin/metrics", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerAdmin)))
+	serverMux.Handle("/api/reset", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerResets)))
+	serverMux.Handle("/admin/wordlist", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerWordList)))
+	serverMux.Handle("/admin/wordlist/{word}", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerWordList)))
+	serverMux.Handle("/admin/users/{userId}/role", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerUserRole)))
+	serverMux.HandleFunc("GET /api/chirps", apiCfg.handlerChirp)
+	serverMux.Handle("POST /api/chirps", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerChirp)))
+	serverMux.HandleFunc("GET /api/chirps/{chirpId}", apiCfg.handlerChirp)
+	serverMux.Handle("PUT /api/chirps/{chirpId}", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerChirp)))
+	serverMux.Handle("DELETE /api/chirps/{chirpId}", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerChirp)))
+	serverMux.HandleFunc("/api/chirps/{chirpId}/history", apiCfg.handlerChirpHistory)
+	serverMux.Handle("POST /api/chirps/{chirpId}/restore", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerChirpRestore)))
+	serverMux.Handle("POST /api/chirps/{chirpId}/report", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerChirpReport)))
+	serverMux.Handle("/admin/reports", apiCfg.requireRole(roleModerator, http.HandlerFunc(apiCfg.handlerReports)))
+	serverMux.Handle("/admin/reports/{reportId}/{action}", apiCfg.requireRole(roleModerator, http.HandlerFunc(apiCfg.handlerReportAction)))
+	serverMux.HandleFunc("POST /api/users", apiCfg.handlerUser)
+	serverMux.Handle("PUT /api/users", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerUser)))
 	serverMux.HandleFunc("/api/login", apiCfg.handlerLogin)
 	serverMux.HandleFunc("/api/refresh", apiCfg.handlerRefresh)
 	serverMux.HandleFunc("/api/revoke", apiCfg.handlerRevoke)
+	serverMux.Handle("GET /api/sessions", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerSessions)))
+	serverMux.Handle("DELETE /api/sessions/{sessionId}", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerDeleteSession)))
+	serverMux.Handle("GET /api/entitlements", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerEntitlements)))
+	serverMux.Handle("POST /api/logout", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerLogout)))
+	serverMux.Handle("POST /api/logout/all", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerLogoutAll)))
 	serverMux.HandleFunc("/api/polka/webhooks", apiCfg.handlerWebhook)
+	serverMux.Handle("/admin/webhooks", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerWebhookEvents)))
+	serverMux.Handle("/admin/webhooks/{eventId}/replay", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerWebhookReplay)))
+	serverMux.Handle("/api/webhooks", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerWebhookEndpoints)))
+	serverMux.Handle("DELETE /api/webhooks/{endpointId}", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerDeleteWebhookEndpoint)))
+	serverMux.Handle("GET /api/webhooks/{endpointId}/deliveries", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerWebhookDeliveries)))
+	serverMux.Handle("POST /api/deliveries/{deliveryId}/retry", apiCfg.RequireAuth(http.HandlerFunc(apiCfg.handlerDeliveryRetry)))
+	serverMux.Handle("/admin/deliveries", apiCfg.requireRole(roleAdmin, http.HandlerFunc(apiCfg.handlerDeadDeliveries)))
 
 	server := http.Server{
 		Addr:    ":8080",
@@ -1,32 +1,203 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id        int        `json:"id"`
+	PublicId  string     `json:"public_id,omitempty"`
+	Body      string     `json:"body"`
+	AuthorId  int        `json:"author_id"`
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	HiddenAt  *time.Time `json:"hidden_at,omitempty"`
 }
+
+// visible reports whether a chirp is neither deleted nor hidden by moderation
+func (chirp Chirp) visible() bool {
+	return chirp.DeletedAt == nil && chirp.HiddenAt == nil
+}
+
+// ChirpVersion is a body a chirp had before it was edited
+type ChirpVersion struct {
+	ChirpId    int       `json:"chirp_id"`
+	Version    int       `json:"version"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// Report is a user flagging a chirp for moderation. ChirpBody is the
+// body as it was reported, in case the chirp is edited afterwards.
+type Report struct {
+	Id         int        `json:"id"`
+	ChirpId    int        `json:"chirp_id"`
+	ReporterId int        `json:"reporter_id"`
+	Reason     string     `json:"reason"`
+	ChirpBody  string     `json:"chirp_body"`
+	Status     string     `json:"status"` // open, hidden or dismissed
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// WebhookEvent is a webhook delivery kept in the inbox, by the id its
+// sender gave it, so a retried delivery is only processed once.
+type WebhookEvent struct {
+	Id          int             `json:"id"`
+	Source      string          `json:"source"`
+	EventId     string          `json:"event_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"` // received, processed, ignored or failed
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ProcessedAt *time.Time      `json:"processed_at,omitempty"`
+}
+
+// WebhookEndpoint is a URL a user wants events posted to. AllUsers
+// endpoints, which only admins can register, get everyone's events,
+// others only the events of their owner.
+type WebhookEndpoint struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	AllUsers  bool      `json:"all_users"`
+	Secret    string    `json:"secret,omitempty"` // only shown when the endpoint is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event on its way to one endpoint. It is
+// retried with exponential backoff until it is delivered or runs out
+// of attempts and is dead.
+type WebhookDelivery struct {
+	Id            int             `json:"id"`
+	EndpointId    int             `json:"endpoint_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"` // pending, delivered or dead
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	ResponseCode  int             `json:"response_code,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+}
+
 type User struct {
-	Id             int       `json:"id"`
-	Email          string    `json:"email"`
-	IsChirpyRed    bool      `json:"is_chirpy_red"`
-	Password       string    `json:"password"`
-	RefreshToken   string    `json:"refresh_token"`
-	ExpiresRefresh time.Time `json:"expires_in_seconds_refresh,omitempty"`
-	Expires        int       `json:"expires_in_seconds,omitempty"`
+	Id          int       `json:"id"`
+	PublicId    string    `json:"public_id,omitempty"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Role        string    `json:"role"`
+	Password    string    `json:"password"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// TokenVersion is in every access token issued to the user,
+	// bumping it revokes them all
+	TokenVersion int `json:"token_version"`
+
+	// Subscription is what IsChirpyRed is worked out from
+	Subscription Subscription `json:"subscription"`
+}
+
+// Subscription is the Chirpy Red subscription of a user, driven by
+// Polka webhooks. The user is on the chirpy_red plan until ExpiresAt,
+// or a grace period after it while a renewal is late.
+type Subscription struct {
+	Plan        string     `json:"plan"`   // free or chirpy_red
+	Status      string     `json:"status"` // none, active, past_due, cancelled, expired or refunded
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	RenewedAt   *time.Time `json:"renewed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
 }
 
 type UserOut struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id           int          `json:"id"`
+	PublicId     string       `json:"public_id,omitempty"`
+	Email        string       `json:"email"`
+	IsChirpyRed  bool         `json:"is_chirpy_red"`
+	Subscription Subscription `json:"subscription"`
+	Role         string       `json:"role"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+func toUserOut(user User) UserOut {
+	return UserOut{
+		Id:           user.Id,
+		PublicId:     user.PublicId,
+		Email:        user.Email,
+		IsChirpyRed:  user.IsChirpyRed,
+		Subscription: user.Subscription,
+		Role:         user.Role,
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
+	}
+}
+
+// Session is a login on one device, it lasts as long as its refresh
+// token. Only the SHA-256 of the token is kept. Every refresh rotates
+// the token: the old one is kept with RotatedAt set, and a new one is
+// added to the same family, the login it descends from.
+type Session struct {
+	Id         int        `json:"id"`
+	FamilyId   int        `json:"family_id"`
+	UserId     int        `json:"user_id"`
+	TokenHash  string     `json:"token_hash"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+}
+
+// RevokedToken is an access token revoked before it expired, by its
+// jti. It only needs to be kept until then.
+type RevokedToken struct {
+	Id        string    `json:"jti"`
+	UserId    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type SessionOut struct {
+	Id         int       `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func toSessionOut(session Session) SessionOut {
+	return SessionOut{
+		Id:         session.FamilyId,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.ExpiresAt,
+	}
 }
 
 type UserOutLogin struct {
-	Email        string `json:"email"`
-	UserId       int    `json:"id"`
-	Token        string `json:"token"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Email            string       `json:"email"`
+	UserId           int          `json:"id"`
+	PublicId         string       `json:"public_id,omitempty"`
+	Token            string       `json:"token"`
+	ExpiresAt        time.Time    `json:"expires_at"`
+	ExpiresIn        int          `json:"expires_in"`
+	RefreshToken     string       `json:"refresh_token"`
+	RefreshExpiresAt time.Time    `json:"refresh_expires_at"`
+	IsChirpyRed      bool         `json:"is_chirpy_red"`
+	Subscription     Subscription `json:"subscription"`
+	Role             string       `json:"role"`
 }
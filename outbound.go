@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// webhookEventNames are the events endpoints can subscribe to
+var webhookEventNames = []string{"chirp.created", "chirp.updated", "chirp.deleted", "user.upgraded"}
+
+// deliveryBatch is how many deliveries the worker attempts per run
+const deliveryBatch = 50
+
+// deliveryWorkers is how many of them are attempted at once, so one
+// slow endpoint doesn't hold up the rest of the batch
+const deliveryWorkers = 8
+
+// maxDeliveryBackoff caps the wait between two attempts
+const maxDeliveryBackoff = 6 * time.Hour
+
+// ErrForbiddenAddress is an endpoint on loopback, a private network
+// or anything else that isn't the public internet
+var ErrForbiddenAddress = errors.New("address is not public")
+
+// allowPrivateWebhooks lets endpoints be on any address, for
+// deployments whose webhook consumers live on the internal network
+var allowPrivateWebhooks = false
+
+// nonPublicPrefixes are the reserved ranges netip has no method for
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// webhookAddressAllowed reports whether deliveries may go to addr
+func webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return false
+	}
+	if allowPrivateWebhooks {
+		return true
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost resolves the host of an endpoint and makes sure
+// every address it has is one deliveries may go to
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// webhookDialer checks the address it is about to connect to, after
+// resolution, so a host that resolved to a public address when it
+// was registered can't be pointed somewhere else later
+var webhookDialer = &net.Dialer{
+	Timeout: 5 * time.Second,
+	Control: func(network string, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !webhookAddressAllowed(addr) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	},
+}
+
+// webhookClient posts deliveries, only to public addresses and never
+// through a proxy. Redirects aren't followed, an endpoint that moved
+// has to be registered again.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         webhookDialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// receives reports whether an endpoint wants event about userId.
+// Events about other users only go to all users endpoints whose owner,
+// with ownerRole, is still an admin.
+func (endpoint WebhookEndpoint) receives(event string, userId int, ownerRole string) bool {
+	if endpoint.UserId != userId && !(endpoint.AllUsers && hasRole(ownerRole, roleAdmin)) {
+		return false
+	}
+	for _, e := range endpoint.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// emit queues an event about userId's chirps or account for the
+// endpoints that want it. Failing to queue it is only logged, it
+// never fails the request the event came from.
+func (cfg *apiConfig) emit(event string, userId int, data interface{}) {
+	payload, err := json.Marshal(struct {
+		Id        string      `json:"id"`
+		Event     string      `json:"event"`
+		CreatedAt time.Time   `json:"created_at"`
+		Data      interface{} `json:"data"`
+	}{
+		Id:        uuid.NewString(),
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err == nil {
+		_, err = cfg.DB.EnqueueWebhookDeliveries(event, userId, payload)
+	}
+	if err != nil {
+		log.Printf("queueing %s webhooks: %v", event, err)
+	}
+}
+
+// deliverWebhooks attempts the deliveries that are due
+func (cfg *apiConfig) deliverWebhooks() error {
+	due, err := cfg.DB.DueWebhookDeliveries(time.Now().UTC(), deliveryBatch)
+	if err != nil {
+		return err
+	}
+
+	endpoints := map[int]WebhookEndpoint{}
+	for _, delivery := range due {
+		if _, ok := endpoints[delivery.EndpointId]; ok {
+			continue
+		}
+		endpoint, err := cfg.DB.GetWebhookEndpoint(delivery.EndpointId)
+		if errors.Is(err, ErrNotFound) {
+			// deleted since, its deliveries went with it
+			continue
+		} else if err != nil {
+			return err
+		}
+		endpoints[endpoint.Id] = endpoint
+	}
+
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	var firstErr error
+	workers := make(chan struct{}, deliveryWorkers)
+	for _, delivery := range due {
+		endpoint, ok := endpoints[delivery.EndpointId]
+		if !ok {
+			continue
+		}
+
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(delivery WebhookDelivery) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			delivery = cfg.attemptDelivery(endpoint, delivery, time.Now().UTC())
+			err := cfg.DB.SaveWebhookDelivery(delivery)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				mux.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mux.Unlock()
+			}
+		}(delivery)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// attemptDelivery posts a delivery once and works out what comes
+// next: done, another attempt after a backoff, or dead once it is
+// out of attempts
+func (cfg *apiConfig) attemptDelivery(endpoint WebhookEndpoint, delivery WebhookDelivery, now time.Time) WebhookDelivery {
+	delivery.Attempts++
+	code, err := postWebhook(endpoint, delivery, now)
+	delivery.ResponseCode = code
+	if err == nil {
+		delivery.Status = "delivered"
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+		return delivery
+	}
+
+	delivery.LastError = deliveryError(err)
+	if delivery.Attempts >= cfg.config.DeliveryAttempts {
+		delivery.Status = "dead"
+		log.Printf("webhook delivery %d to endpoint %d is dead after %d attempts: %v", delivery.Id, endpoint.Id, delivery.Attempts, err)
+		return delivery
+	}
+	delivery.NextAttemptAt = now.Add(deliveryBackoff(delivery.Attempts, cfg.config.DeliveryBackoff))
+	return delivery
+}
+
+// deliveryError is what the delivery log says about a failed attempt.
+// Errors from connecting are boiled down to what kind they were, their
+// details would tell endpoint owners about the network we are on.
+func deliveryError(err error) string {
+	var status statusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &status):
+		return err.Error()
+	case errors.Is(err, ErrForbiddenAddress):
+		return "endpoint address is not public"
+	case errors.As(err, &dnsErr):
+		return "endpoint host could not be resolved"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "endpoint timed out"
+	default:
+		return "could not connect to the endpoint"
+	}
+}
+
+// statusError is an endpoint answering with anything but a 2xx
+type statusError struct {
+	status string
+}
+
+func (e statusError) Error() string {
+	return "endpoint answered " + e.status
+}
+
+// deliveryBackoff is how long to wait after a failed attempt,
+// doubling from base with every attempt
+func deliveryBackoff(attempts int, base time.Duration) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxDeliveryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxDeliveryBackoff {
+		return maxDeliveryBackoff
+	}
+	return backoff
+}
+
+// postWebhook sends a delivery signed with the endpoint's secret,
+// anything but a 2xx is a failure
+func postWebhook(endpoint WebhookEndpoint, delivery WebhookDelivery, now time.Time) (int, error) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := hex.EncodeToString(webhookSignature([]byte(endpoint.Secret), timestamp, delivery.Payload))
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Chirpy-Event", delivery.Event)
+	req.Header.Set("Chirpy-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("Chirpy-Signature", "t="+timestamp+",v1="+signature)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, statusError{status: resp.Status}
+	}
+	return resp.StatusCode, nil
+}
+
+// makeWebhookSecret is the secret deliveries to a new endpoint are signed with
+func makeWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// validWebhookEvents checks the events an endpoint subscribes to
+// and drops duplicates
+func validWebhookEvents(events []string) ([]string, bool) {
+	valid := []string{}
+	seen := map[string]bool{}
+	for _, event := range events {
+		known := false
+		for _, name := range webhookEventNames {
+			known = known || event == name
+		}
+		if !known {
+			return nil, false
+		}
+		if !seen[event] {
+			seen[event] = true
+			valid = append(valid, event)
+		}
+	}
+	return valid, len(valid) > 0
+}
+
+// ownedEndpoint finds an endpoint of the principal, admins can get
+// at anyone's. Others' endpoints are reported as not found.
+func (cfg *apiConfig) ownedEndpoint(principal Principal, endpointId int) (WebhookEndpoint, error) {
+	endpoint, err := cfg.DB.GetWebhookEndpoint(endpointId)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	if endpoint.UserId != principal.UserId && !principal.HasRole(roleAdmin) {
+		return WebhookEndpoint{}, ErrNotFound
+	}
+	return endpoint, nil
+}
+
+// handlerWebhookEndpoints lists the caller's endpoints and registers
+// new ones. The secret is only returned when the endpoint is created.
+func (cfg *apiConfig) handlerWebhookEndpoints(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		endpoints, err := cfg.DB.GetWebhookEndpoints(principal.UserId)
+		if err != nil {
+			w = respondWithError(w, 500, "Something went wrong")
+			return
+		}
+		for i := range endpoints {
+			endpoints[i].Secret = ""
+		}
+		w = respondWithJSON(w, 200, endpoints)
+
+	} else if req.Method == http.MethodPost {
+		type parameters struct {
+			URL      string   `json:"url"`
+			Events   []string `json:"events"`
+			AllUsers bool     `json:"all_users"`
+		}
+
+		decoder := json.NewDecoder(req.Body)
+		params := parameters{}
+		err := decoder.Decode(&params)
+		if err != nil {
+			w = respondWithError(w, 400, "Something went wrong")
+			return
+		}
+
+		target, err := url.Parse(params.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+			w = respondWithError(w, 400, "url must be an http or https URL")
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		err = checkWebhookHost(ctx, target.Hostname())
+		cancel()
+		if errors.Is(err, ErrForbiddenAddress) {
+			w = respondWithError(w, 400, "url must be on a public address")
+			return
+		} else if err != nil {
+			w = respondWithError(w, 400, "url host could not be resolved")
+			return
+		}
+		events, ok := validWebhookEvents(params.Events)
+		if !ok {
+			w = respondWithError(w, 400, "events must be a non-empty list of "+fmt.Sprint(webhookEventNames))
+			return
+		}
+		if params.AllUsers && !principal.HasRole(roleAdmin) {
+			w = respondWithError(w, 403, "Requires the admin role")
+			return
+		}
+
+		secret, err := makeWebhookSecret()
+		if err != nil {
+			w = respondWithError(w, 500, "Something went wrong")
+			return
+		}
+		endpoint, err := cfg.DB.CreateWebhookEndpoint(principal.UserId, target.String(), events, params.AllUsers, secret)
+		if err != nil {
+			w = respondWithError(w, 500, "Something went wrong")
+			return
+		}
+		w = respondWithJSON(w, 201, endpoint)
+
+	} else {
+		w = respondWithError(w, 405, "Method not allowed")
+	}
+}
+
+// handlerDeleteWebhookEndpoint stops deliveries to an endpoint
+func (cfg *apiConfig) handlerDeleteWebhookEndpoint(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	endpointId, err := strconv.Atoi(req.PathValue("endpointId"))
+	if err != nil {
+		w = respondWithError(w, 404, "Webhook endpoint does not exist")
+		return
+	}
+	_, err = cfg.ownedEndpoint(principal, endpointId)
+	if err == nil {
+		err = cfg.DB.DeleteWebhookEndpoint(endpointId)
+	}
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Webhook endpoint does not exist")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// deliveryStatus reads ?status for delivery lists, def when it is missing
+func deliveryStatus(req *http.Request, def string) (string, bool) {
+	status := req.URL.Query().Get("status")
+	switch status {
+	case "":
+		return def, true
+	case "pending", "delivered", "dead":
+		return status, true
+	case "all":
+		return "", true
+	}
+	return "", false
+}
+
+// handlerWebhookDeliveries is the delivery log of an endpoint, newest
+// first, ?status=pending, delivered or dead to filter
+func (cfg *apiConfig) handlerWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	endpointId, err := strconv.Atoi(req.PathValue("endpointId"))
+	if err != nil {
+		w = respondWithError(w, 404, "Webhook endpoint does not exist")
+		return
+	}
+	status, ok := deliveryStatus(req, "")
+	if !ok {
+		w = respondWithError(w, 400, "status must be pending, delivered, dead or all")
+		return
+	}
+
+	_, err = cfg.ownedEndpoint(principal, endpointId)
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Webhook endpoint does not exist")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+
+	deliveries, err := cfg.DB.GetWebhookDeliveries(endpointId, status)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, deliveries)
+}
+
+// handlerDeliveryRetry gives a dead delivery a fresh set of attempts
+func (cfg *apiConfig) handlerDeliveryRetry(w http.ResponseWriter, req *http.Request) {
+	principal, ok := principalFrom(req.Context())
+	if !ok {
+		respondUnauthorized(w, "", "No Authorization Token")
+		return
+	}
+
+	deliveryId, err := strconv.Atoi(req.PathValue("deliveryId"))
+	if err != nil {
+		w = respondWithError(w, 404, "Delivery does not exist")
+		return
+	}
+	delivery, err := cfg.DB.GetWebhookDelivery(deliveryId)
+	if err == nil {
+		_, err = cfg.ownedEndpoint(principal, delivery.EndpointId)
+	}
+	if errors.Is(err, ErrNotFound) {
+		w = respondWithError(w, 404, "Delivery does not exist")
+		return
+	} else if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	if delivery.Status != "dead" {
+		w = respondWithError(w, 409, "Only dead deliveries can be retried")
+		return
+	}
+
+	delivery.Status = "pending"
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now().UTC()
+	err = cfg.DB.SaveWebhookDelivery(delivery)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, delivery)
+}
+
+// handlerDeadDeliveries is the dead letter list across every
+// endpoint, ?status=pending, delivered or all for the others
+func (cfg *apiConfig) handlerDeadDeliveries(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w = respondWithError(w, 405, "Method not allowed")
+		return
+	}
+
+	status, ok := deliveryStatus(req, "dead")
+	if !ok {
+		w = respondWithError(w, 400, "status must be pending, delivered, dead or all")
+		return
+	}
+
+	deliveries, err := cfg.DB.GetWebhookDeliveries(0, status)
+	if err != nil {
+		w = respondWithError(w, 500, "Something went wrong")
+		return
+	}
+	w = respondWithJSON(w, 200, deliveries)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::7f00:1", false},
+	}
+
+	for _, tt := range tests {
+		if got := webhookAddressAllowed(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("webhookAddressAllowed(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer server.Close()
+
+	_, err := webhookClient.Get(server.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("Get() error = %v, want ErrForbiddenAddress", err)
+	}
+	if got := deliveryError(err); got != "endpoint address is not public" {
+		t.Errorf("deliveryError() = %q", got)
+	}
+}
+
+func TestPurgeDeliveredWebhooks(t *testing.T) {
+	now := time.Now().UTC()
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			user, err := store.CreateUser("alice@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateWebhookEndpoint(user.Id, "https://example.com/hook", []string{"chirp.created"}, false, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 3 {
+				_, err = store.EnqueueWebhookDeliveries("chirp.created", user.Id, []byte(`{}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			due, err := store.DueWebhookDeliveries(time.Now().UTC(), 10)
+			if err != nil || len(due) != 3 {
+				t.Fatalf("DueWebhookDeliveries() = %d, %v", len(due), err)
+			}
+
+			// an old delivery, a recent one and an old dead one
+			old, recent := now.Add(-2*time.Hour), now.Add(-time.Minute)
+			due[0].Status, due[0].DeliveredAt = "delivered", &old
+			due[1].Status, due[1].DeliveredAt = "delivered", &recent
+			due[2].Status, due[2].NextAttemptAt = "dead", old
+			for _, delivery := range due {
+				err = store.SaveWebhookDelivery(delivery)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			purged, err := store.PurgeDeliveredWebhooks(now.Add(-time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != 1 {
+				t.Errorf("purged %d, want 1", purged)
+			}
+			left, err := store.GetWebhookDeliveries(0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != 2 || left[0].Id != due[2].Id || left[1].Id != due[1].Id {
+				t.Errorf("left %v, want deliveries %d and %d", left, due[2].Id, due[1].Id)
+			}
+		})
+	}
+}
+
+func TestAllUsersEndpointOwnerDemoted(t *testing.T) {
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			admin, err := store.CreateUser("admin@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := store.CreateUser("bob@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.SetUserRole(admin.Id, roleAdmin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateWebhookEndpoint(admin.Id, "https://example.com/hook", []string{"chirp.created"}, true, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []struct {
+				name   string
+				role   string
+				userId int
+				queued int
+			}{
+				{"admin gets other users' events", roleAdmin, bob.Id, 1},
+				{"admin gets their own", roleAdmin, admin.Id, 1},
+				{"demoted owner doesn't get other users' events", roleUser, bob.Id, 0},
+				{"demoted owner still gets their own", roleUser, admin.Id, 1},
+				{"moderator doesn't get other users' events", roleModerator, bob.Id, 0},
+			}
+			for _, step := range steps {
+				_, err = store.SetUserRole(admin.Id, step.role)
+				if err != nil {
+					t.Fatal(err)
+				}
+				queued, err := store.EnqueueWebhookDeliveries("chirp.created", step.userId, []byte(`{}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if queued != step.queued {
+					t.Errorf("%s: queued %d, want %d", step.name, queued, step.queued)
+				}
+			}
+		})
+	}
+}
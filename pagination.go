@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page asks for at most Limit chirps starting after Cursor.
+// A zero Limit means no pagination at all.
+type Page struct {
+	Limit  int
+	Cursor string
+}
+
+// chirpCursor is what an opaque cursor decodes to:
+// the position of the last chirp of the previous page
+type chirpCursor struct {
+	LastId        int       `json:"last_id"`
+	LastCreatedAt time.Time `json:"last_created_at"`
+}
+
+func cursorFor(chirp Chirp) chirpCursor {
+	return chirpCursor{LastId: chirp.Id, LastCreatedAt: chirp.CreatedAt}
+}
+
+func encodeCursor(c chirpCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (chirpCursor, error) {
+	c := chirpCursor{}
+	if s == "" {
+		return c, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	err = json.Unmarshal(data, &c)
+	if err != nil || c.LastId <= 0 {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// paginate cuts one page out of chirps, which must already be sorted
+// with q.less, and returns the cursor of the next page or "" when
+// this is the last one
+func paginate(chirps []Chirp, q ChirpQuery) ([]Chirp, string, error) {
+	cursor, err := decodeCursor(q.Page.Cursor)
+	if err != nil {
+		return []Chirp{}, "", err
+	}
+
+	if cursor.LastId > 0 {
+		last := Chirp{Id: cursor.LastId, CreatedAt: cursor.LastCreatedAt}
+		start := 0
+		for start < len(chirps) && !q.less(last, chirps[start]) {
+			start++
+		}
+		chirps = chirps[start:]
+	}
+
+	if q.Page.Limit == 0 || len(chirps) <= q.Page.Limit {
+		return chirps, "", nil
+	}
+	chirps = chirps[:q.Page.Limit]
+	return chirps, encodeCursor(cursorFor(chirps[len(chirps)-1])), nil
+}
+
+// parsePage reads the limit and cursor query parameters.
+// ok is false when the client asked for no pagination.
+func parsePage(req *http.Request) (page Page, ok bool, err error) {
+	query := req.URL.Query()
+	if !query.Has("limit") && !query.Has("cursor") {
+		return Page{}, false, nil
+	}
+
+	page = Page{Limit: defaultPageSize, Cursor: query.Get("cursor")}
+	if s := query.Get("limit"); s != "" {
+		page.Limit, err = strconv.Atoi(s)
+		if err != nil || page.Limit < 1 {
+			return Page{}, true, fmt.Errorf("limit must be a positive number")
+		}
+	}
+	if page.Limit > maxPageSize {
+		page.Limit = maxPageSize
+	}
+
+	_, err = decodeCursor(page.Cursor)
+	if err != nil {
+		return Page{}, true, err
+	}
+	return page, true, nil
+}
+
+// respondWithPage writes a page of chirps along with its
+// next_cursor, and a Link header pointing at the next page
+func respondWithPage(w http.ResponseWriter, req *http.Request, chirps []Chirp, nextCursor string) {
+	if nextCursor != "" {
+		next := url.URL{Path: req.URL.Path}
+		query := req.URL.Query()
+		query.Set("cursor", nextCursor)
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	}
+
+	type response struct {
+		Chirps     []Chirp `json:"chirps"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}
+	respondWithJSON(w, 200, response{
+		Chirps:     chirps,
+		NextCursor: nextCursor,
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrBadSignature = errors.New("webhook signature does not match")
+	ErrStaleWebhook = errors.New("webhook timestamp is outside the tolerance window")
+
+	// ErrApiKeyDisabled is a webhook with the old ApiKey header while
+	// --polka-api-key is off, most likely from a Polka not signing yet
+	ErrApiKeyDisabled = fmt.Errorf("%w: unsigned webhook with an ApiKey header, have Polka sign webhooks or turn on --polka-api-key", ErrBadSignature)
+)
+
+// polka checks that webhooks really come from Polka
+var polka *WebhookVerifier
+
+// WebhookVerifier authenticates Polka webhooks. Polka signs each one
+// with a Polka-Signature header of the form t=<unix time>,v1=<hex>
+// where v1 is the HMAC-SHA256 of "<t>.<raw body>". Every secret is
+// tried, so a new one can be added before Polka switches to it and
+// the old one removed after. A signature outside the tolerance is
+// rejected, a redelivery within it is deduplicated by the inbox.
+type WebhookVerifier struct {
+	secrets     [][]byte
+	tolerance   time.Duration
+	allowApiKey bool
+}
+
+// newWebhookVerifier accepts signatures made with any of secrets.
+// allowApiKey also lets through the old "Authorization: ApiKey
+// <secret>" header, only meant for migrating Polka to signatures.
+func newWebhookVerifier(secrets []string, tolerance time.Duration, allowApiKey bool) *WebhookVerifier {
+	v := &WebhookVerifier{
+		tolerance:   tolerance,
+		allowApiKey: allowApiKey,
+	}
+	for _, secret := range secrets {
+		v.secrets = append(v.secrets, []byte(secret))
+	}
+	return v
+}
+
+// Verify authenticates a webhook from its headers and raw body
+func (v *WebhookVerifier) Verify(header http.Header, body []byte, now time.Time) error {
+	signature := header.Get("Polka-Signature")
+	if signature == "" {
+		apiKey, found := strings.CutPrefix(header.Get("Authorization"), "ApiKey ")
+		if !found {
+			return ErrBadSignature
+		}
+		if !v.allowApiKey {
+			return ErrApiKeyDisabled
+		}
+		return v.verifyApiKey(apiKey)
+	}
+
+	timestamp, signatures := parseSignatureHeader(signature)
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrBadSignature
+	}
+	age := now.Sub(time.Unix(signedAt, 0))
+	if age > v.tolerance || age < -v.tolerance {
+		return ErrStaleWebhook
+	}
+
+	for _, secret := range v.secrets {
+		expected := webhookSignature(secret, timestamp, body)
+		for _, sig := range signatures {
+			decoded, err := hex.DecodeString(sig)
+			if err == nil && hmac.Equal(decoded, expected) {
+				return nil
+			}
+		}
+	}
+	return ErrBadSignature
+}
+
+// verifyApiKey checks the deprecated ApiKey header, which has no
+// timestamp and so no protection against replays
+func (v *WebhookVerifier) verifyApiKey(apiKey string) error {
+	for _, secret := range v.secrets {
+		if subtle.ConstantTimeCompare([]byte(apiKey), secret) == 1 {
+			log.Printf("deprecated: accepted a polka webhook authenticated with an ApiKey header, have Polka sign webhooks and turn off --polka-api-key")
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// webhookSignature is the HMAC-SHA256 of "<timestamp>.<body>", the
+// same scheme signs Polka's webhooks and ours
+func webhookSignature(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// parseSignatureHeader splits "t=<timestamp>,v1=<sig>,v1=<sig>",
+// there can be several v1 while Polka rotates its secret
+func parseSignatureHeader(header string) (timestamp string, signatures []string) {
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	return timestamp, signatures
+}
+
+// webhookEventKey stands in for the id of an event Polka sent without
+// one. A redelivery comes with the same signature, so the signed
+// timestamp along with the body tells it apart from another event
+// that happens to have the same body. An unsigned event has nothing
+// to tell them apart by, each one is taken as a new event.
+func webhookEventKey(header http.Header, body []byte) string {
+	timestamp, _ := parseSignatureHeader(header.Get("Polka-Signature"))
+	if timestamp == "" {
+		return "unsigned:" + uuid.NewString()
+	}
+	return "sha256:" + sha256Hex([]byte(timestamp+"."+string(body)))
+}
+
+// splitSecrets parses a comma separated list of secrets
+func splitSecrets(s string) []string {
+	secrets := []string{}
+	for _, secret := range strings.Split(s, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// polkaEvent is the body of a Polka webhook. ExpiresAt, when Polka
+// sends it, is when the period just paid for ends.
+type polkaEvent struct {
+	Id    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserId    int       `json:"user_id"`
+		ExpiresAt time.Time `json:"expires_at"`
+	} `json:"data"`
+}
+
+// processWebhookEvent applies an event from the inbox and records the
+// outcome on it. The error is the one that made it fail, if it did.
+func (cfg *apiConfig) processWebhookEvent(event WebhookEvent) (WebhookEvent, error) {
+	status, err := cfg.applyPolkaEvent(event.Payload)
+	errMsg := ""
+	if err != nil {
+		status, errMsg = "failed", err.Error()
+		log.Printf("webhook event %d failed: %v", event.Id, err)
+	}
+
+	finished, recordErr := cfg.DB.FinishWebhookEvent(event.Id, status, errMsg)
+	if recordErr != nil {
+		return WebhookEvent{}, recordErr
+	}
+	return finished, err
+}
+
+// applyPolkaEvent moves the user's subscription along for a Polka
+// event, events we don't handle are ignored
+func (cfg *apiConfig) applyPolkaEvent(payload []byte) (string, error) {
+	params := polkaEvent{}
+	err := json.Unmarshal(payload, &params)
+	if err != nil {
+		return "", err
+	}
+
+	switch params.Event {
+	case "user.upgraded", "user.renewed", "user.payment_failed", "user.downgraded", "user.refunded":
+	default:
+		return "ignored", nil
+	}
+
+	now := time.Now().UTC()
+	wasRed := false
+	user, err := cfg.DB.UpdateSubscription(params.Data.UserId, func(sub Subscription) Subscription {
+		wasRed = sub.Plan == planChirpyRed
+		return sub.apply(params.Event, now, cfg.config.SubscriptionPeriod, params.Data.ExpiresAt)
+	})
+	if err != nil {
+		return "", fmt.Errorf("user %d: %w", params.Data.UserId, err)
+	}
+	if !wasRed && user.IsChirpyRed {
+		cfg.emit("user.upgraded", user.Id, user)
+	}
+	return "processed", nil
+}
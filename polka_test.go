@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func signWebhook(secret string, timestamp time.Time, body string) string {
+	t := fmt.Sprint(timestamp.Unix())
+	return hex.EncodeToString(webhookSignature([]byte(secret), t, []byte(body)))
+}
+
+func TestWebhookVerifierVerify(t *testing.T) {
+	now := time.Unix(1718000000, 0)
+	tolerance := 5 * time.Minute
+	body := `{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`
+	signed := func(at time.Time, signatures ...string) http.Header {
+		header := fmt.Sprintf("t=%d", at.Unix())
+		for _, sig := range signatures {
+			header += ",v1=" + sig
+		}
+		return http.Header{"Polka-Signature": {header}}
+	}
+
+	tests := []struct {
+		name        string
+		header      http.Header
+		body        string
+		allowApiKey bool
+		wantErr     error
+	}{
+		{
+			name:   "valid signature",
+			header: signed(now, signWebhook("new", now, body)),
+		},
+		{
+			name:   "signed with the old secret while rotating",
+			header: signed(now, signWebhook("old", now, body)),
+		},
+		{
+			name:   "two v1 while rotating, first unknown",
+			header: signed(now, signWebhook("next", now, body), signWebhook("new", now, body)),
+		},
+		{
+			name:    "two v1 while rotating, neither known",
+			header:  signed(now, signWebhook("next", now, body), signWebhook("other", now, body)),
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "wrong secret",
+			header:  signed(now, signWebhook("wrong", now, body)),
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "body changed after signing",
+			header:  signed(now, signWebhook("new", now, body)),
+			body:    `{"id":"evt_1","event":"user.upgraded","data":{"user_id":2}}`,
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "timestamp changed after signing",
+			header:  signed(now.Add(-time.Second), signWebhook("new", now, body)),
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "not hex",
+			header:  signed(now, "zz"),
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "no v1",
+			header:  signed(now),
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "no timestamp",
+			header:  http.Header{"Polka-Signature": {"v1=" + signWebhook("new", now, body)}},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:   "at the edge of the tolerance",
+			header: signed(now.Add(-tolerance), signWebhook("new", now.Add(-tolerance), body)),
+		},
+		{
+			name:    "older than the tolerance",
+			header:  signed(now.Add(-tolerance-time.Second), signWebhook("new", now.Add(-tolerance-time.Second), body)),
+			wantErr: ErrStaleWebhook,
+		},
+		{
+			name:    "further ahead than the tolerance",
+			header:  signed(now.Add(tolerance+time.Second), signWebhook("new", now.Add(tolerance+time.Second), body)),
+			wantErr: ErrStaleWebhook,
+		},
+		{
+			name:    "no signature",
+			header:  http.Header{},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "api key when not allowed",
+			header:  http.Header{"Authorization": {"ApiKey new"}},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "api key when not allowed says why",
+			header:  http.Header{"Authorization": {"ApiKey new"}},
+			wantErr: ErrApiKeyDisabled,
+		},
+		{
+			name:        "api key when allowed",
+			header:      http.Header{"Authorization": {"ApiKey old"}},
+			allowApiKey: true,
+		},
+		{
+			name:        "wrong api key",
+			header:      http.Header{"Authorization": {"ApiKey wrong"}},
+			allowApiKey: true,
+			wantErr:     ErrBadSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newWebhookVerifier([]string{"old", "new"}, tolerance, tt.allowApiKey)
+			if tt.body == "" {
+				tt.body = body
+			}
+			err := v.Verify(tt.header, []byte(tt.body), now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookVerifierRedelivery(t *testing.T) {
+	now := time.Unix(1718000000, 0)
+	tolerance := 5 * time.Minute
+	body := `{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`
+	header := http.Header{"Polka-Signature": {fmt.Sprintf("t=%d,v1=%s", now.Unix(), signWebhook("new", now, body))}}
+
+	// Polka redelivers with the same signature, within the window it
+	// verifies and the inbox dedupes it, after it is a replay
+	tests := []struct {
+		name    string
+		at      time.Time
+		wantErr error
+	}{
+		{"first delivery", now, nil},
+		{"redelivered right away", now.Add(time.Second), nil},
+		{"redelivered later in the window", now.Add(tolerance), nil},
+		{"replayed after the window", now.Add(tolerance + time.Second), ErrStaleWebhook},
+	}
+
+	v := newWebhookVerifier([]string{"new"}, tolerance, false)
+	for _, tt := range tests {
+		err := v.Verify(header, []byte(body), tt.at)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebhookEventKey(t *testing.T) {
+	now := time.Unix(1718000000, 0)
+	body := `{"event":"user.renewed","data":{"user_id":1}}`
+	signed := func(at time.Time, body string) http.Header {
+		return http.Header{"Polka-Signature": {fmt.Sprintf("t=%d,v1=%s", at.Unix(), signWebhook("new", at, body))}}
+	}
+	first := webhookEventKey(signed(now, body), []byte(body))
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		same   bool
+	}{
+		{"redelivery", signed(now, body), body, true},
+		{"same body sent again later", signed(now.Add(time.Hour), body), body, false},
+		{"other body", signed(now, `{"event":"user.renewed","data":{"user_id":2}}`), `{"event":"user.renewed","data":{"user_id":2}}`, false},
+		{"unsigned", http.Header{"Authorization": {"ApiKey new"}}, body, false},
+	}
+
+	for _, tt := range tests {
+		if got := webhookEventKey(tt.header, []byte(tt.body)); (got == first) != tt.same {
+			t.Errorf("%s: key %q, same as the first %v, want %v", tt.name, got, got == first, tt.same)
+		}
+	}
+
+	unsigned := http.Header{"Authorization": {"ApiKey new"}}
+	if webhookEventKey(unsigned, []byte(body)) == webhookEventKey(unsigned, []byte(body)) {
+		t.Error("two unsigned events got the same key")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultBadWords are used when there is no word list file yet
+var defaultBadWords = []string{
+	"kerfuffle",
+	"sharbert",
+	"fornax",
+}
+
+var maskStyles = []string{"fixed", "full", "first", "grawlix"}
+
+// homoglyphs maps characters that look like latin letters to them
+var homoglyphs = map[rune]rune{
+	// cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i',
+	'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	// greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// leetspeak maps digits and symbols used in place of letters.
+// Punctuation that also ends sentences, like '!', is left alone.
+var leetspeak = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't',
+	'@': 'a', '$': 's',
+}
+
+// normalizeRune folds r to the plain lowercase latin letter it is
+// meant to look like: diacritics are stripped, fullwidth forms,
+// homoglyphs and leetspeak are mapped
+func normalizeRune(r rune) rune {
+	if r >= '！' && r <= '～' {
+		r = r - '！' + '!'
+	}
+	for _, d := range norm.NFD.String(string(r)) {
+		if !unicode.Is(unicode.Mn, d) {
+			r = d
+			break
+		}
+	}
+	r = unicode.ToLower(r)
+	if mapped, ok := homoglyphs[r]; ok {
+		return mapped
+	}
+	if mapped, ok := leetspeak[r]; ok {
+		return mapped
+	}
+	return r
+}
+
+func normalizeWord(s string) string {
+	runes := []rune(strings.TrimSpace(s))
+	for i, r := range runes {
+		runes[i] = normalizeRune(r)
+	}
+	return string(runes)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// matcher is an Aho-Corasick automaton over normalized runes, it
+// finds every word of the list in one pass over the text however
+// long the list gets
+type matcher struct {
+	next []map[rune]int
+	fail []int
+	out  [][]int // lengths of the words ending at each node
+}
+
+func newMatcher(words []string) *matcher {
+	m := &matcher{
+		next: []map[rune]int{{}},
+		fail: []int{0},
+		out:  [][]int{nil},
+	}
+
+	for _, word := range words {
+		node := 0
+		runes := []rune(word)
+		for _, r := range runes {
+			child, ok := m.next[node][r]
+			if !ok {
+				child = len(m.next)
+				m.next = append(m.next, map[rune]int{})
+				m.fail = append(m.fail, 0)
+				m.out = append(m.out, nil)
+				m.next[node][r] = child
+			}
+			node = child
+		}
+		m.out[node] = append(m.out[node], len(runes))
+	}
+
+	queue := []int{}
+	for _, child := range m.next[0] {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for r, child := range m.next[node] {
+			fail := m.fail[node]
+			for fail != 0 && m.next[fail][r] == 0 {
+				fail = m.fail[fail]
+			}
+			if target, ok := m.next[fail][r]; ok && target != child {
+				m.fail[child] = target
+			}
+			m.out[child] = append(m.out[child], m.out[m.fail[child]]...)
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+// match is a word found at text[start:end], in runes
+type match struct {
+	start int
+	end   int
+}
+
+// find returns the non-overlapping whole-word matches in text,
+// preferring the earliest and then the longest
+func (m *matcher) find(text []rune) []match {
+	found := []match{}
+	node := 0
+	for i, r := range text {
+		for node != 0 && m.next[node][r] == 0 {
+			node = m.fail[node]
+		}
+		node = m.next[node][r]
+
+		end := i + 1
+		for _, length := range m.out[node] {
+			start := end - length
+			if start > 0 && isWordRune(text[start-1]) {
+				continue
+			}
+			if end < len(text) && isWordRune(text[end]) {
+				continue
+			}
+			found = append(found, match{start, end})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].start != found[j].start {
+			return found[i].start < found[j].start
+		}
+		return found[i].end > found[j].end
+	})
+	matches := []match{}
+	for _, f := range found {
+		if len(matches) > 0 && f.start < matches[len(matches)-1].end {
+			continue
+		}
+		matches = append(matches, f)
+	}
+	return matches
+}
+
+// WordFilter masks the words of a moderation list in chirps.
+// The list lives in a file, one word per line with # comments,
+// and is saved back whenever it is edited.
+type WordFilter struct {
+	path      string
+	maskStyle string
+	mux       *sync.RWMutex
+	words     map[string]bool
+	matcher   *matcher
+}
+
+// loadWordFilter reads the word list at path, falling back to
+// defaultBadWords when the file does not exist yet
+func loadWordFilter(path string, maskStyle string) (*WordFilter, error) {
+	filter := &WordFilter{
+		path:      path,
+		maskStyle: maskStyle,
+		mux:       &sync.RWMutex{},
+		words:     map[string]bool{},
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		filter.add(defaultBadWords)
+		return filter, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	filter.add(words)
+	return filter, nil
+}
+
+// add puts words in the list and rebuilds the matcher, the caller
+// must hold the lock
+func (f *WordFilter) add(words []string) {
+	for _, word := range words {
+		word = normalizeWord(word)
+		if word != "" {
+			f.words[word] = true
+		}
+	}
+	f.matcher = newMatcher(f.list())
+}
+
+// list returns the words sorted, the caller must hold the lock
+func (f *WordFilter) list() []string {
+	words := make([]string, 0, len(f.words))
+	for word := range f.words {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return words
+}
+
+// Words returns the list, normalized and sorted
+func (f *WordFilter) Words() []string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return f.list()
+}
+
+// AddWords adds words to the list and saves it
+func (f *WordFilter) AddWords(words []string) ([]string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.add(words)
+	return f.list(), f.save()
+}
+
+// RemoveWord takes word out of the list and saves it
+func (f *WordFilter) RemoveWord(word string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	word = normalizeWord(word)
+	if !f.words[word] {
+		return ErrNotFound
+	}
+	delete(f.words, word)
+	f.matcher = newMatcher(f.list())
+	return f.save()
+}
+
+// save writes the list to a temporary file and renames it over
+// the old one, so a crash never leaves half a list behind
+func (f *WordFilter) save() error {
+	var b strings.Builder
+	b.WriteString("# one word per line, managed through /admin/wordlist\n")
+	for _, word := range f.list() {
+		b.WriteString(word)
+		b.WriteString("\n")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(b.String())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Clean masks every word of the list found in s. Matching ignores
+// case, diacritics, homoglyphs and leetspeak, and only whole words
+// count, so "kerfuffle!" is masked but "kerfuffles" is not.
+func (f *WordFilter) Clean(s string) string {
+	original := []rune(s)
+	normalized := make([]rune, len(original))
+	for i, r := range original {
+		normalized[i] = normalizeRune(r)
+	}
+
+	f.mux.RLock()
+	matches := f.matcher.find(normalized)
+	f.mux.RUnlock()
+	if len(matches) == 0 {
+		return s
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(string(original[last:m.start]))
+		b.WriteString(mask(original[m.start:m.end], f.maskStyle))
+		last = m.end
+	}
+	b.WriteString(string(original[last:]))
+	return b.String()
+}
+
+func mask(word []rune, style string) string {
+	switch style {
+	case "full":
+		return strings.Repeat("*", len(word))
+	case "first":
+		return string(word[0]) + strings.Repeat("*", len(word)-1)
+	case "grawlix":
+		symbols := []rune("@#$%&!")
+		masked := make([]rune, len(word))
+		for i := range word {
+			masked[i] = symbols[i%len(symbols)]
+		}
+		return string(masked)
+	default:
+		return "****"
+	}
+}
+
+func validMaskStyle(style string) error {
+	for _, s := range maskStyles {
+		if style == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("--mask-style must be one of %s", strings.Join(maskStyles, ", "))
+}
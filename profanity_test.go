@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestWordFilter(t *testing.T, words []string, maskStyle string) *WordFilter {
+	t.Helper()
+	filter, err := loadWordFilter(filepath.Join(t.TempDir(), "wordlist.txt"), maskStyle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words != nil {
+		filter.words = map[string]bool{}
+		filter.add(words)
+	}
+	return filter
+}
+
+func TestWordFilterClean(t *testing.T) {
+	tests := []struct {
+		name      string
+		words     []string // nil for defaultBadWords
+		maskStyle string
+		in        string
+		want      string
+	}{
+		{"lowercase", nil, "fixed", "what a kerfuffle", "what a ****"},
+		{"uppercase", nil, "fixed", "KERFUFFLE", "****"},
+		{"mixed case", nil, "fixed", "KerFuFFle", "****"},
+		{"punctuation around", nil, "fixed", "(kerfuffle!)", "(****!)"},
+		{"several", nil, "fixed", "Sharbert, fornax and kerfuffle", "****, **** and ****"},
+		{"longer word", nil, "fixed", "kerfuffles", "kerfuffles"},
+		{"inside a word", nil, "fixed", "ankerfuffle", "ankerfuffle"},
+		{"joined by a digit", nil, "fixed", "kerfuffle2", "kerfuffle2"},
+		{"leetspeak", nil, "fixed", "k3rfuffl3", "****"},
+		{"leetspeak symbols", nil, "fixed", "$h@rbert", "****"},
+		{"diacritics", nil, "fixed", "kérfüffle", "****"},
+		{"cyrillic homoglyphs", nil, "fixed", "k\u0435rfuffl\u0435", "****"},
+		{"fullwidth", nil, "fixed", "ｋｅｒｆｕｆｆｌｅ", "****"},
+		{"nothing to mask", nil, "fixed", "all good here", "all good here"},
+		{"empty", nil, "fixed", "", ""},
+
+		{"overlapping words", []string{"he", "she", "hers"}, "fixed", "she said hers, he said", "**** said ****, **** said"},
+		{"words that contain others", []string{"he", "she", "hers"}, "fixed", "ushers", "ushers"},
+		{"shared suffix", []string{"sharbert", "bert"}, "fixed", "sharbert bert", "**** ****"},
+		{"longest match wins", []string{"bad", "bad word"}, "fixed", "a bad word here", "a **** here"},
+		{"shorter match still whole words", []string{"bad", "bad word"}, "fixed", "bad words", "**** words"},
+
+		{"full mask", nil, "full", "Kerfuffle!", "*********!"},
+		{"first letter kept", nil, "first", "Kerfuffle!", "K********!"},
+		{"first letter kept as typed", nil, "first", "k3rfuffle", "k********"},
+		{"grawlix", nil, "grawlix", "fornax", "@#$%&!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := newTestWordFilter(t, tt.words, tt.maskStyle)
+			if got := filter.Clean(tt.in); got != tt.want {
+				t.Errorf("Clean(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeWord(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Kerfuffle", "kerfuffle"},
+		{"  fornax ", "fornax"},
+		{"K3RFUFFL3", "kerfuffle"},
+		{"$h@rb3rt", "sharbert"},
+		{"fórnàx", "fornax"},
+		{"\u0455\u0430rb\u0435rt", "sarbert"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeWord(tt.in); got != tt.want {
+			t.Errorf("normalizeWord(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWordFilterEdits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wordlist.txt")
+	filter, err := loadWordFilter(path, "fixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		edit  func() error
+		words []string
+		in    string
+		want  string
+	}{
+		{
+			name:  "defaults",
+			edit:  func() error { return nil },
+			words: []string{"fornax", "kerfuffle", "sharbert"},
+			in:    "fornax and flibbertigibbet",
+			want:  "**** and flibbertigibbet",
+		},
+		{
+			name: "added words are normalized and matched",
+			edit: func() error {
+				_, err := filter.AddWords([]string{"Flibbertigibbet", " K3rfuffle "})
+				return err
+			},
+			words: []string{"flibbertigibbet", "fornax", "kerfuffle", "sharbert"},
+			in:    "fornax and flibbertigibbet",
+			want:  "**** and ****",
+		},
+		{
+			name:  "removed words no longer match",
+			edit:  func() error { return filter.RemoveWord("FORNAX") },
+			words: []string{"flibbertigibbet", "kerfuffle", "sharbert"},
+			in:    "fornax and flibbertigibbet",
+			want:  "fornax and ****",
+		},
+		{
+			name: "removing a missing word",
+			edit: func() error {
+				err := filter.RemoveWord("fornax")
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("RemoveWord() error = %v, want ErrNotFound", err)
+				}
+				return nil
+			},
+			words: []string{"flibbertigibbet", "kerfuffle", "sharbert"},
+			in:    "fornax and flibbertigibbet",
+			want:  "fornax and ****",
+		},
+	}
+
+	for _, step := range steps {
+		err := step.edit()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := filter.Words(); !reflect.DeepEqual(got, step.words) {
+			t.Errorf("%s: Words() = %v, want %v", step.name, got, step.words)
+		}
+		if got := filter.Clean(step.in); got != step.want {
+			t.Errorf("%s: Clean(%q) = %q, want %q", step.name, step.in, got, step.want)
+		}
+
+		// the list was saved as it is now
+		reloaded, err := loadWordFilter(path, "fixed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reloaded.Words(); !reflect.DeepEqual(got, step.words) {
+			t.Errorf("%s: reloaded Words() = %v, want %v", step.name, got, step.words)
+		}
+	}
+}
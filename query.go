@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChirpQuery selects, orders and pages chirps.
+// Every Store applies it the same way.
+type ChirpQuery struct {
+	AuthorIds []int     // any of these authors, all when empty
+	Since     time.Time // created at or after, unbounded when zero
+	Until     time.Time // created before, unbounded when zero
+	Text      string    // case-insensitive substring of the body
+	SortBy    string    // "id" (default) or "created_at"
+	Desc      bool
+	Page      Page
+}
+
+// matches reports whether chirp passes the filters of q
+func (q ChirpQuery) matches(chirp Chirp) bool {
+	if len(q.AuthorIds) > 0 {
+		found := false
+		for _, id := range q.AuthorIds {
+			if chirp.AuthorId == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) {
+		return false
+	}
+	if q.Text != "" && !containsFold(chirp.Body, q.Text) {
+		return false
+	}
+	return true
+}
+
+// less orders chirps the way q asks for, ties on created_at
+// are broken by id so the order is always total
+func (q ChirpQuery) less(a Chirp, b Chirp) bool {
+	if q.SortBy == "created_at" && !a.CreatedAt.Equal(b.CreatedAt) {
+		if q.Desc {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	if q.Desc {
+		return a.Id > b.Id
+	}
+	return a.Id < b.Id
+}
+
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// parseChirpQuery reads the listing parameters of GET /api/chirps:
+// sort=asc|desc, sort_by=id|created_at, author_id (repeated or comma
+// separated), since and until (RFC 3339), q, limit and cursor.
+// paginated is false when the client asked for no pagination.
+func parseChirpQuery(req *http.Request) (q ChirpQuery, paginated bool, err error) {
+	query := req.URL.Query()
+
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, false, fmt.Errorf("sort must be asc or desc")
+	}
+
+	q.SortBy = query.Get("sort_by")
+	switch q.SortBy {
+	case "":
+		q.SortBy = "id"
+	case "id", "created_at":
+	default:
+		return q, false, fmt.Errorf("sort_by must be id or created_at")
+	}
+
+	for _, value := range query["author_id"] {
+		for _, s := range strings.Split(value, ",") {
+			authorId, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return q, false, fmt.Errorf("invalid author_id %q", s)
+			}
+			q.AuthorIds = append(q.AuthorIds, authorId)
+		}
+	}
+
+	if s := query.Get("since"); s != "" {
+		q.Since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, false, fmt.Errorf("since must be an RFC 3339 timestamp")
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		q.Until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, false, fmt.Errorf("until must be an RFC 3339 timestamp")
+		}
+	}
+
+	q.Text = query.Get("q")
+
+	q.Page, paginated, err = parsePage(req)
+	return q, paginated, err
+}
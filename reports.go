@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// ReportChirp files a report against a visible chirp, each user can
+// report a chirp once. The chirp is hidden as soon as it has hideAfter
+// open reports, a moderator then decides with ResolveReport.
+func (db *DB) ReportChirp(chirpId int, reporterId int, reason string, hideAfter int) (Report, error) {
+	newReport := Report{}
+	err := db.Update(func(tx *DBStructure) error {
+		chirp, exists := tx.Chirps[chirpId]
+		if !exists || !chirp.visible() {
+			return ErrNotFound
+		}
+
+		open := 0
+		for _, report := range tx.Reports {
+			if report.ChirpId != chirpId {
+				continue
+			}
+			if report.ReporterId == reporterId {
+				return ErrAlreadyReported
+			}
+			if report.Status == "open" {
+				open++
+			}
+		}
+
+		now := time.Now().UTC()
+		newReport = Report{
+			Id:         tx.nextId("reports"),
+			ChirpId:    chirpId,
+			ReporterId: reporterId,
+			Reason:     reason,
+			ChirpBody:  chirp.Body,
+			Status:     "open",
+			CreatedAt:  now,
+		}
+		tx.put("reports", newReport.Id, newReport)
+
+		if hideAfter > 0 && open+1 >= hideAfter {
+			chirp.HiddenAt = &now
+			tx.put("chirps", chirpId, chirp)
+		}
+		return nil
+	})
+	return newReport, err
+}
+
+// GetReports lists reports with the given status, or all of them
+// when status is empty, oldest first
+func (db *DB) GetReports(status string) ([]Report, error) {
+	reports := []Report{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, report := range tx.Reports {
+			if status == "" || report.Status == status {
+				reports = append(reports, report)
+			}
+		}
+		return nil
+	})
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Id < reports[j].Id })
+	return reports, err
+}
+
+// ResolveReport hides the reported chirp or dismisses the report,
+// which puts back a chirp that was hidden automatically. The decision
+// closes every open report on the same chirp.
+func (db *DB) ResolveReport(reportId int, hide bool) (Report, error) {
+	resolved := Report{}
+	err := db.Update(func(tx *DBStructure) error {
+		report, exists := tx.Reports[reportId]
+		if !exists {
+			return ErrNotFound
+		}
+
+		now := time.Now().UTC()
+		status := "dismissed"
+		if hide {
+			status = "hidden"
+		}
+
+		if chirp, exists := tx.Chirps[report.ChirpId]; exists {
+			if hide && chirp.HiddenAt == nil {
+				chirp.HiddenAt = &now
+			} else if !hide {
+				chirp.HiddenAt = nil
+			}
+			tx.put("chirps", chirp.Id, chirp)
+		}
+
+		for id, other := range tx.Reports {
+			if id == reportId || (other.ChirpId == report.ChirpId && other.Status == "open") {
+				other.Status = status
+				other.ResolvedAt = &now
+				tx.put("reports", id, other)
+			}
+		}
+		resolved = tx.Reports[reportId]
+		return nil
+	})
+	return resolved, err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeleteHiddenChirp(t *testing.T) {
+	profanity = newTestWordFilter(t, nil, "fixed")
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			alice, err := store.CreateUser("alice@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := store.CreateUser("bob@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirp, err := store.CreateChirp("hello", alice.Id, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.ReportChirp(chirp.Id, bob.Id, "spam", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []struct {
+				name    string
+				run     func() error
+				wantErr error
+			}{
+				{"hidden from readers", func() error { _, err := store.GetChirp(chirp.Id); return err }, ErrNotFound},
+				{"author can't edit it while hidden", func() error { _, err := store.EditChirp(chirp.Id, alice.Id, "edited"); return err }, ErrNotFound},
+				{"others can't delete it", func() error { return store.DeleteChirp(chirp.Id, bob.Id) }, ErrNotFound},
+				{"author deletes it", func() error { return store.DeleteChirp(chirp.Id, alice.Id) }, nil},
+				{"deleted once", func() error { return store.DeleteChirp(chirp.Id, alice.Id) }, ErrNotFound},
+			}
+			for _, step := range steps {
+				if err := step.run(); !errors.Is(err, step.wantErr) {
+					t.Errorf("%s: error = %v, want %v", step.name, err, step.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import "time"
+
+// RevokeAccessToken puts an access token on the denylist until it expires
+func (db *DB) RevokeAccessToken(tokenId string, userId int, expiresAt time.Time) error {
+	return db.Update(func(tx *DBStructure) error {
+		tx.put("revoked_tokens", tokenId, RevokedToken{
+			Id:        tokenId,
+			UserId:    userId,
+			ExpiresAt: expiresAt.UTC(),
+		})
+		return nil
+	})
+}
+
+// AccessTokenRevoked reports whether an access token is on the
+// denylist or was issued before its user's tokens were all revoked
+func (db *DB) AccessTokenRevoked(tokenId string, userId int, tokenVersion int) (bool, error) {
+	revoked := false
+	err := db.View(func(tx *DBStructure) error {
+		_, denied := tx.RevokedTokens[tokenId]
+		user, exists := tx.Users[userId]
+		revoked = denied || !exists || user.TokenVersion != tokenVersion
+		return nil
+	})
+	return revoked, err
+}
+
+// RevokeAllTokens logs a user out everywhere: every access token
+// issued so far stops working and every session is ended
+func (db *DB) RevokeAllTokens(userId int) error {
+	return db.Update(func(tx *DBStructure) error {
+		user, exists := tx.Users[userId]
+		if !exists {
+			return ErrNotFound
+		}
+		user.TokenVersion++
+		user.UpdatedAt = time.Now().UTC()
+		tx.put("users", userId, user)
+
+		for hash, session := range tx.Sessions {
+			if session.UserId == userId {
+				tx.remove("sessions", hash)
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeRevokedTokens drops denylist entries for tokens that expired
+// before before, they would be rejected anyway
+func (db *DB) PurgeRevokedTokens(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *DBStructure) error {
+		for id, token := range tx.RevokedTokens {
+			if token.ExpiresAt.Before(before) {
+				tx.remove("revoked_tokens", id)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
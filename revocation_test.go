@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{}
+	for _, driver := range []string{"json", "sqlite"} {
+		store, err := OpenStore(driver, filepath.Join(t.TempDir(), "database"))
+		if err != nil {
+			t.Fatalf("%s: %v", driver, err)
+		}
+		t.Cleanup(func() { store.Close() })
+		stores[driver] = store
+	}
+	return stores
+}
+
+func TestRoleChangeRevokesAccessTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		revoked bool
+	}{
+		{"demoted admin", roleAdmin, roleUser, true},
+		{"demoted moderator", roleModerator, roleUser, true},
+		{"promoted user", roleUser, roleModerator, true},
+		{"same role", roleAdmin, roleAdmin, false},
+	}
+
+	for driver, store := range openTestStores(t) {
+		for _, tt := range tests {
+			t.Run(driver+"/"+tt.name, func(t *testing.T) {
+				user, err := store.CreateUser(tt.name+"@"+driver+".example.com", "hash")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = store.SetUserRole(user.Id, tt.from)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// an access token issued with the old role
+				before, err := store.GetUserById(user.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				revoked, err := store.AccessTokenRevoked("jti-"+tt.name, user.Id, before.TokenVersion)
+				if err != nil || revoked {
+					t.Fatalf("AccessTokenRevoked() before = %v, %v, want false", revoked, err)
+				}
+
+				updated, err := store.SetUserRole(user.Id, tt.to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if updated.Role != tt.to {
+					t.Errorf("role = %q, want %q", updated.Role, tt.to)
+				}
+
+				revoked, err = store.AccessTokenRevoked("jti-"+tt.name, user.Id, before.TokenVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if revoked != tt.revoked {
+					t.Errorf("AccessTokenRevoked() after = %v, want %v", revoked, tt.revoked)
+				}
+
+				// tokens issued after the change are fine
+				after, err := store.GetUserById(user.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				revoked, err = store.AccessTokenRevoked("jti-"+tt.name+"-new", user.Id, after.TokenVersion)
+				if err != nil || revoked {
+					t.Errorf("AccessTokenRevoked() new token = %v, %v, want false", revoked, err)
+				}
+			})
+		}
+	}
+}
+
+func TestDemotedAdminTokenRejected(t *testing.T) {
+	var err error
+	keys, err = loadKeys("secret", "", "", "chirpy", "chirpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			cfg := &apiConfig{DB: store}
+			admin := cfg.requireRole(roleAdmin, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(204)
+			}))
+			status := func(token string) int {
+				req := httptest.NewRequest("GET", "/admin/metrics", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				rec := httptest.NewRecorder()
+				admin.ServeHTTP(rec, req)
+				return rec.Code
+			}
+
+			created, err := store.CreateUser("admin@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.SetUserRole(created.Id, roleAdmin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := store.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldToken, _ := createJWT(user, time.Hour)
+			if code := status(oldToken); code != 204 {
+				t.Fatalf("admin token got %d, want 204", code)
+			}
+
+			_, err = store.SetUserRole(created.Id, roleUser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code := status(oldToken); code != 401 {
+				t.Errorf("token from before the demotion got %d, want 401", code)
+			}
+
+			user, err = store.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newToken, _ := createJWT(user, time.Hour)
+			if code := status(newToken); code != 403 {
+				t.Errorf("token from after the demotion got %d, want 403", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "net/http"
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// roleRanks orders the roles, each one can do
+// everything the ones below it can
+var roleRanks = map[string]int{
+	roleUser:      1,
+	roleModerator: 2,
+	roleAdmin:     3,
+}
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// hasRole reports whether role is at least required
+func hasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// requireRole only lets through authenticated requests whose role
+// is at least required, others get a 403. The role is the one the
+// access token was issued with.
+func (cfg *apiConfig) requireRole(required string, next http.Handler) http.Handler {
+	return cfg.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		principal, _ := principalFrom(req.Context())
+		if !principal.HasRole(required) {
+			respondWithError(w, 403, "Requires the "+required+" role")
+			return
+		}
+		next.ServeHTTP(w, req)
+	}))
+}
@@ -2,28 +2,53 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-func createJWT(user User) string {
-	var expiresAt time.Time
-	expiresAt = time.Now().Add(1 * time.Hour)
+// chirpyClaims are the claims of an access token, Version is the
+// token version of the user when it was issued
+type chirpyClaims struct {
+	Role    string `json:"role"`
+	Version int    `json:"ver"`
+	jwt.RegisteredClaims
+}
+
+// createJWT issues an access token for user that expires after ttl
+func createJWT(user User, ttl time.Duration) (string, time.Time) {
+	expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Second)
 
-	// if expire == 0 {
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		Subject:   fmt.Sprint(user.Id),
-		ExpiresAt: jwt.NewNumericDate(expiresAt.UTC()),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+	claims := chirpyClaims{
+		Role:    user.Role,
+		Version: user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   fmt.Sprint(user.Id),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ID:        uuid.NewString(),
+		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	jwtSecret := os.Getenv("JWT_SECRET")
+	string, _ := keys.Sign(&claims)
+
+	return string, expiresAt
+}
 
-	string, _ := token.SignedString([]byte(jwtSecret))
+// tokenLifetime is the lifetime asked for in seconds, the default
+// when it is 0 and never more than max
+func tokenLifetime(seconds int, def time.Duration, max time.Duration) time.Duration {
+	if seconds <= 0 {
+		return def
+	}
+	if seconds > int(max/time.Second) {
+		return max
+	}
+	return time.Duration(seconds) * time.Second
+}
 
-	return string
+// parseJWT checks the signature, issuer, audience and expiry of an access token
+func parseJWT(tokenString string) (*chirpyClaims, error) {
+	return keys.Parse(tokenString)
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"time"
+)
+
+// hashToken is how refresh tokens are stored and looked up,
+// the token itself never touches the disk
+func hashToken(token string) string {
+	return sha256Hex([]byte(token))
+}
+
+// tokenMatches reports in constant time whether token hashes to the
+// hash of a stored session. The lookup by hash that found the session
+// can only leak the hash of the token that was sent, this makes sure
+// accepting the token never rests on a compare that can leak more.
+func tokenMatches(hash string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(token))) == 1
+}
+
+// CreateSession starts a session for a refresh token handed out at
+// login, it is the first of its family
+func (db *DB) CreateSession(userId int, token string, userAgent string, ip string, expiresAt time.Time) (Session, error) {
+	session := Session{}
+	err := db.Update(func(tx *DBStructure) error {
+		if _, exists := tx.Users[userId]; !exists {
+			return ErrNotFound
+		}
+
+		now := time.Now().UTC()
+		id := tx.nextId("sessions")
+		session = Session{
+			Id:         id,
+			FamilyId:   id,
+			UserId:     userId,
+			TokenHash:  hashToken(token),
+			UserAgent:  userAgent,
+			IP:         ip,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			ExpiresAt:  expiresAt.UTC(),
+		}
+		tx.put("sessions", session.TokenHash, session)
+		return nil
+	})
+	return session, err
+}
+
+// currentSession looks up the session of a refresh token. A token
+// rotated less than grace ago is still accepted, two tabs refreshing
+// at once both present it. Past that it is being reused, most likely
+// stolen, so its whole family is revoked and ErrTokenReused returned.
+func (tx *DBStructure) currentSession(token string, now time.Time, grace time.Duration) (Session, error) {
+	session, exists := tx.Sessions[hashToken(token)]
+	if !exists || !tokenMatches(session.TokenHash, token) || !session.ExpiresAt.After(now) {
+		return Session{}, ErrNotFound
+	}
+	if session.RotatedAt != nil && now.Sub(*session.RotatedAt) > grace {
+		tx.revokeFamily(session.FamilyId)
+		return Session{}, ErrTokenReused
+	}
+	return session, nil
+}
+
+func (tx *DBStructure) revokeFamily(familyId int) {
+	for hash, session := range tx.Sessions {
+		if session.FamilyId == familyId {
+			tx.remove("sessions", hash)
+		}
+	}
+}
+
+// RefreshTokenValid finds the session of a refresh token and, if it
+// hasn't expired or been rotated, marks it used and returns its user
+func (db *DB) RefreshTokenValid(token string) (User, bool, error) {
+	found := User{}
+	valid := false
+	err := db.Update(func(tx *DBStructure) error {
+		now := time.Now().UTC()
+		session, err := tx.currentSession(token, now, 0)
+		if err != nil {
+			return nil
+		}
+		user, exists := tx.Users[session.UserId]
+		if !exists {
+			return nil
+		}
+
+		session.LastUsedAt = now
+		tx.put("sessions", session.TokenHash, session)
+		found, valid = user, true
+		return nil
+	})
+	return found, valid, err
+}
+
+// RotateRefreshToken retires token and puts newToken in its place, in
+// the same family and with the same expiry. A token rotated less than
+// grace ago gets another successor, both stay valid. Returns
+// ErrNotFound for an unknown or expired token and ErrTokenReused for
+// one rotated before that.
+func (db *DB) RotateRefreshToken(token string, newToken string, grace time.Duration) (User, Session, error) {
+	found := User{}
+	rotated := Session{}
+	var reused error
+	err := db.Update(func(tx *DBStructure) error {
+		now := time.Now().UTC()
+		session, err := tx.currentSession(token, now, grace)
+		if errors.Is(err, ErrTokenReused) {
+			// commit the revocation, report the reuse afterwards
+			reused = err
+			return nil
+		} else if err != nil {
+			return err
+		}
+		user, exists := tx.Users[session.UserId]
+		if !exists {
+			return ErrNotFound
+		}
+
+		// the grace runs from the first rotation, using the token
+		// again doesn't extend it
+		if session.RotatedAt == nil {
+			session.RotatedAt = &now
+			tx.put("sessions", session.TokenHash, session)
+		}
+
+		rotated = session
+		rotated.Id = tx.nextId("sessions")
+		rotated.TokenHash = hashToken(newToken)
+		rotated.LastUsedAt = now
+		rotated.RotatedAt = nil
+		tx.put("sessions", rotated.TokenHash, rotated)
+
+		found = user
+		return nil
+	})
+	if err == nil {
+		err = reused
+	}
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	return found, rotated, nil
+}
+
+// RevokeToken ends the session of a refresh token, with its whole family
+func (db *DB) RevokeToken(token string) error {
+	return db.Update(func(tx *DBStructure) error {
+		if session, exists := tx.Sessions[hashToken(token)]; exists && tokenMatches(session.TokenHash, token) {
+			tx.revokeFamily(session.FamilyId)
+		}
+		return nil
+	})
+}
+
+// GetSessions lists the sessions of a user that haven't expired,
+// newest first, one per family. A family has more than one current
+// token after concurrent refreshes, the latest stands for it.
+func (db *DB) GetSessions(userId int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(tx *DBStructure) error {
+		now := time.Now().UTC()
+		latest := map[int]Session{}
+		for _, session := range tx.Sessions {
+			if session.UserId == userId && session.RotatedAt == nil && session.ExpiresAt.After(now) && session.Id > latest[session.FamilyId].Id {
+				latest[session.FamilyId] = session
+			}
+		}
+		for _, session := range latest {
+			sessions = append(sessions, session)
+		}
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].FamilyId > sessions[j].FamilyId })
+	return sessions, err
+}
+
+// DeleteSession ends one of the sessions of a user, sessionId is the
+// id of its family, which sessions are known by
+func (db *DB) DeleteSession(userId int, sessionId int) error {
+	return db.Update(func(tx *DBStructure) error {
+		for _, session := range tx.Sessions {
+			if session.FamilyId == sessionId && session.UserId == userId {
+				tx.revokeFamily(sessionId)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// PurgeExpiredSessions deletes sessions that expired before before
+func (db *DB) PurgeExpiredSessions(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *DBStructure) error {
+		for hash, session := range tx.Sessions {
+			if session.ExpiresAt.Before(before) {
+				tx.remove("sessions", hash)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,1379 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by an embedded SQLite database
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+// sqliteMigrations are applied in order, the index+1 of the last
+// applied migration is kept in PRAGMA user_version.
+// Never edit a migration that has shipped, append a new one.
+// Ids are AUTOINCREMENT so SQLite never reuses a deleted one.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		email           TEXT NOT NULL UNIQUE,
+		password        TEXT NOT NULL,
+		is_chirpy_red   INTEGER NOT NULL DEFAULT 0,
+		refresh_token   TEXT NOT NULL DEFAULT '',
+		expires_refresh DATETIME
+	);
+	CREATE INDEX users_refresh_token ON users (refresh_token);
+	CREATE TABLE chirps (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		body      TEXT NOT NULL,
+		author_id INTEGER NOT NULL REFERENCES users (id)
+	);
+	CREATE INDEX chirps_author_id ON chirps (author_id);`,
+
+	`ALTER TABLE users ADD COLUMN public_id TEXT;
+	CREATE UNIQUE INDEX users_public_id ON users (public_id);
+	ALTER TABLE chirps ADD COLUMN public_id TEXT;
+	CREATE UNIQUE INDEX chirps_public_id ON chirps (public_id);`,
+
+	`ALTER TABLE chirps ADD COLUMN created_at DATETIME;
+	UPDATE chirps SET created_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now');
+	CREATE INDEX chirps_created_at ON chirps (created_at, id);`,
+
+	`ALTER TABLE chirps ADD COLUMN updated_at DATETIME;
+	UPDATE chirps SET updated_at = created_at;
+	ALTER TABLE users ADD COLUMN created_at DATETIME;
+	ALTER TABLE users ADD COLUMN updated_at DATETIME;
+	UPDATE users SET created_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now'), updated_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now');`,
+
+	`ALTER TABLE chirps ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+	CREATE TABLE chirp_versions (
+		chirp_id    INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+		version     INTEGER NOT NULL,
+		body        TEXT NOT NULL,
+		created_at  DATETIME NOT NULL,
+		replaced_at DATETIME NOT NULL,
+		PRIMARY KEY (chirp_id, version)
+	);`,
+
+	`ALTER TABLE chirps ADD COLUMN deleted_at DATETIME;
+	CREATE INDEX chirps_deleted_at ON chirps (deleted_at);`,
+
+	`ALTER TABLE chirps ADD COLUMN hidden_at DATETIME;
+	CREATE TABLE reports (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		chirp_id    INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+		reporter_id INTEGER NOT NULL REFERENCES users (id),
+		reason      TEXT NOT NULL DEFAULT '',
+		chirp_body  TEXT NOT NULL,
+		status      TEXT NOT NULL DEFAULT 'open',
+		created_at  DATETIME NOT NULL,
+		resolved_at DATETIME,
+		UNIQUE (chirp_id, reporter_id)
+	);
+	CREATE INDEX reports_status ON reports (status, id);`,
+
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+
+	`CREATE TABLE sessions (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash   TEXT NOT NULL UNIQUE,
+		user_id      INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		user_agent   TEXT NOT NULL DEFAULT '',
+		ip           TEXT NOT NULL DEFAULT '',
+		created_at   DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL,
+		expires_at   DATETIME NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions (user_id);
+	CREATE INDEX sessions_expires_at ON sessions (expires_at);`,
+
+	`ALTER TABLE sessions ADD COLUMN family_id INTEGER NOT NULL DEFAULT 0;
+	UPDATE sessions SET family_id = id;
+	ALTER TABLE sessions ADD COLUMN rotated_at DATETIME;
+	CREATE INDEX sessions_family_id ON sessions (family_id);`,
+
+	// the plaintext refresh tokens from before sessions
+	`DROP INDEX users_refresh_token;
+	ALTER TABLE users DROP COLUMN refresh_token;
+	ALTER TABLE users DROP COLUMN expires_refresh;`,
+
+	`ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE revoked_tokens (
+		jti        TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at);`,
+
+	`CREATE TABLE webhook_events (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		source       TEXT NOT NULL,
+		event_id     TEXT NOT NULL,
+		event        TEXT NOT NULL,
+		payload      TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		error        TEXT NOT NULL DEFAULT '',
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		received_at  DATETIME NOT NULL,
+		processed_at DATETIME,
+		UNIQUE (source, event_id)
+	);
+	CREATE INDEX webhook_events_status ON webhook_events (status, id);`,
+
+	`ALTER TABLE users ADD COLUMN plan TEXT NOT NULL DEFAULT 'free';
+	ALTER TABLE users ADD COLUMN subscription_status TEXT NOT NULL DEFAULT 'none';
+	ALTER TABLE users ADD COLUMN subscription_started_at DATETIME;
+	ALTER TABLE users ADD COLUMN subscription_renewed_at DATETIME;
+	ALTER TABLE users ADD COLUMN subscription_expires_at DATETIME;
+	ALTER TABLE users ADD COLUMN subscription_cancelled_at DATETIME;
+	UPDATE users SET plan = 'chirpy_red', subscription_status = 'active', subscription_started_at = updated_at WHERE is_chirpy_red = 1;
+	CREATE INDEX users_subscription_expires_at ON users (subscription_expires_at) WHERE plan = 'chirpy_red';`,
+
+	`CREATE TABLE webhook_endpoints (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		url        TEXT NOT NULL,
+		events     TEXT NOT NULL,
+		all_users  INTEGER NOT NULL DEFAULT 0,
+		secret     TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX webhook_endpoints_user_id ON webhook_endpoints (user_id);
+	CREATE TABLE webhook_deliveries (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		endpoint_id     INTEGER NOT NULL REFERENCES webhook_endpoints (id) ON DELETE CASCADE,
+		event           TEXT NOT NULL,
+		payload         TEXT NOT NULL,
+		status          TEXT NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_error      TEXT NOT NULL DEFAULT '',
+		response_code   INTEGER NOT NULL DEFAULT 0,
+		created_at      DATETIME NOT NULL,
+		delivered_at    DATETIME
+	);
+	CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+	CREATE INDEX webhook_deliveries_endpoint_id ON webhook_deliveries (endpoint_id, id);`,
+}
+
+func init() {
+	// lower() and LIKE only fold ASCII, contains_fold folds
+	// the same way ChirpQuery.matches does for the JSON store
+	sqlite.MustRegisterDeterministicScalarFunction("contains_fold", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, _ := args[0].(string)
+		substr, _ := args[1].(string)
+		return containsFold(s, substr), nil
+	})
+}
+
+// NewSQLiteDB opens (or creates) the SQLite database at path
+// and brings its schema up to date. Times are always written in UTC
+// with _time_format=sqlite so they compare correctly as text.
+// secure_delete zeroes deleted rows, like revoked sessions, on disk.
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_pragma=secure_delete(1)&_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only has one writer anyway, a single connection
+	// avoids SQLITE_BUSY between our own goroutines
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteDB{db: db}
+	err = s.migrate()
+	if err == nil {
+		err = s.backfillPublicIds()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteDB) migrate() error {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqliteMigrations[i])
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < len(sqliteMigrations) {
+		// old page images, of dropped columns for instance,
+		// would otherwise linger in the WAL file
+		_, err = s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillPublicIds gives a public id to the chirps and users created
+// while public ids were off. Like the JSON store it runs on every
+// open, public ids can be turned on at any time.
+func (s *SQLiteDB) backfillPublicIds() error {
+	if publicIdFormat == "" {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"chirps", "users"} {
+		rows, err := tx.Query("SELECT id, created_at FROM " + table + " WHERE public_id IS NULL")
+		if err != nil {
+			return err
+		}
+		missing := map[int]time.Time{}
+		for rows.Next() {
+			var id int
+			var createdAt time.Time
+			err = rows.Scan(&id, &createdAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			missing[id] = createdAt
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for id, createdAt := range missing {
+			_, err = tx.Exec("UPDATE "+table+" SET public_id = ? WHERE id = ?", newPublicIdAt(createdAt), id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// CreateChirp counts the author's recent chirps and inserts the new
+// one in the same transaction, see DB.CreateChirp
+func (s *SQLiteDB) CreateChirp(body string, authorId int, perHour int) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if perHour > 0 {
+		recent := 0
+		err = tx.QueryRow("SELECT COUNT(*) FROM chirps WHERE author_id = ? AND created_at > ?", authorId, now.Add(-time.Hour)).Scan(&recent)
+		if err != nil {
+			return Chirp{}, err
+		}
+		if recent >= perHour {
+			return Chirp{}, ErrRateLimited
+		}
+	}
+
+	chirp := Chirp{
+		PublicId:  newPublicId(),
+		Body:      cleanBody(body),
+		AuthorId:  authorId,
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	res, err := tx.Exec("INSERT INTO chirps (public_id, body, author_id, version, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		nullString(chirp.PublicId), chirp.Body, chirp.AuthorId, chirp.Version, chirp.CreatedAt, chirp.UpdatedAt)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.Id = int(id)
+	return chirp, tx.Commit()
+}
+
+// DeleteChirp soft deletes a chirp, see DB.DeleteChirp
+func (s *SQLiteDB) DeleteChirp(chirpId int, userId int) error {
+	chirp, err := scanChirp(s.db.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ? AND deleted_at IS NULL", chirpId))
+	if err != nil {
+		return err
+	}
+	if chirp.HiddenAt != nil && chirp.AuthorId != userId {
+		return ErrNotFound
+	}
+	if chirp.AuthorId != userId {
+		return ErrNotAuthorized
+	}
+
+	_, err = s.db.Exec("UPDATE chirps SET deleted_at = ? WHERE id = ?", time.Now().UTC(), chirpId)
+	return err
+}
+
+func (s *SQLiteDB) RestoreChirp(chirpId int, userId int, deletedAfter time.Time) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ?", chirpId))
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorId != userId {
+		return Chirp{}, ErrNotAuthorized
+	}
+	if chirp.DeletedAt == nil {
+		return chirp, nil
+	}
+	if chirp.DeletedAt.Before(deletedAfter) {
+		return Chirp{}, ErrExpired
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET deleted_at = NULL WHERE id = ?", chirpId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.DeletedAt = nil
+	return chirp, tx.Commit()
+}
+
+// PurgeDeletedChirps hard deletes chirps soft deleted before
+// deletedBefore, their versions go with them through ON DELETE CASCADE
+func (s *SQLiteDB) PurgeDeletedChirps(deletedBefore time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM chirps WHERE deleted_at IS NOT NULL AND deleted_at < ?", deletedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
+
+// EditChirp replaces the body of a chirp, keeping the old one in chirp_versions
+func (s *SQLiteDB) EditChirp(chirpId int, userId int, body string) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ? AND deleted_at IS NULL AND hidden_at IS NULL", chirpId))
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorId != userId {
+		return Chirp{}, ErrNotAuthorized
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO chirp_versions (chirp_id, version, body, created_at, replaced_at) VALUES (?, ?, ?, ?, ?)",
+		chirp.Id, chirp.Version, chirp.Body, chirp.UpdatedAt.UTC(), now)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp.Body = cleanBody(body)
+	chirp.Version++
+	chirp.UpdatedAt = now
+	_, err = tx.Exec("UPDATE chirps SET body = ?, version = ?, updated_at = ? WHERE id = ?",
+		chirp.Body, chirp.Version, chirp.UpdatedAt, chirp.Id)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, tx.Commit()
+}
+
+func (s *SQLiteDB) GetChirpHistory(chirpId int) ([]ChirpVersion, error) {
+	_, err := s.GetChirp(chirpId)
+	if err != nil {
+		return []ChirpVersion{}, err
+	}
+
+	rows, err := s.db.Query("SELECT chirp_id, version, body, created_at, replaced_at FROM chirp_versions WHERE chirp_id = ? ORDER BY version", chirpId)
+	if err != nil {
+		return []ChirpVersion{}, err
+	}
+	defer rows.Close()
+
+	history := []ChirpVersion{}
+	for rows.Next() {
+		version := ChirpVersion{}
+		err = rows.Scan(&version.ChirpId, &version.Version, &version.Body, &version.CreatedAt, &version.ReplacedAt)
+		if err != nil {
+			return []ChirpVersion{}, err
+		}
+		history = append(history, version)
+	}
+	return history, rows.Err()
+}
+
+const sqliteChirpColumns = "id, public_id, body, author_id, version, created_at, updated_at, deleted_at, hidden_at"
+
+func scanChirp(row interface{ Scan(...interface{}) error }) (Chirp, error) {
+	chirp := Chirp{}
+	var publicId sql.NullString
+	var deletedAt, hiddenAt sql.NullTime
+	err := row.Scan(&chirp.Id, &publicId, &chirp.Body, &chirp.AuthorId, &chirp.Version, &chirp.CreatedAt, &chirp.UpdatedAt, &deletedAt, &hiddenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.PublicId = publicId.String
+	if deletedAt.Valid {
+		chirp.DeletedAt = &deletedAt.Time
+	}
+	if hiddenAt.Valid {
+		chirp.HiddenAt = &hiddenAt.Time
+	}
+	return chirp, nil
+}
+
+// GetChirps translates q into SQL, resuming after q.Page.Cursor.
+// One extra row is fetched to know if there is a next page.
+func (s *SQLiteDB) GetChirps(q ChirpQuery) ([]Chirp, string, error) {
+	cursor, err := decodeCursor(q.Page.Cursor)
+	if err != nil {
+		return []Chirp{}, "", err
+	}
+
+	conditions := []string{"deleted_at IS NULL AND hidden_at IS NULL"}
+	args := []interface{}{}
+	if len(q.AuthorIds) > 0 {
+		placeholders := make([]string, len(q.AuthorIds))
+		for i, id := range q.AuthorIds {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		conditions = append(conditions, "author_id IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if !q.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, q.Until.UTC())
+	}
+	if q.Text != "" {
+		conditions = append(conditions, "contains_fold(body, ?)")
+		args = append(args, q.Text)
+	}
+
+	cmp := ">"
+	order := "ASC"
+	if q.Desc {
+		cmp = "<"
+		order = "DESC"
+	}
+	if cursor.LastId > 0 {
+		if q.SortBy == "created_at" {
+			conditions = append(conditions, "(created_at "+cmp+" ? OR (created_at = ? AND id "+cmp+" ?))")
+			args = append(args, cursor.LastCreatedAt.UTC(), cursor.LastCreatedAt.UTC(), cursor.LastId)
+		} else {
+			conditions = append(conditions, "id "+cmp+" ?")
+			args = append(args, cursor.LastId)
+		}
+	}
+
+	query := "SELECT " + sqliteChirpColumns + " FROM chirps WHERE " + strings.Join(conditions, " AND ")
+	if q.SortBy == "created_at" {
+		query += " ORDER BY created_at " + order + ", id " + order
+	} else {
+		query += " ORDER BY id " + order
+	}
+	if q.Page.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Page.Limit+1)
+	}
+
+	chirps, err := s.queryChirps(query, args...)
+	if err != nil {
+		return []Chirp{}, "", err
+	}
+	if q.Page.Limit == 0 || len(chirps) <= q.Page.Limit {
+		return chirps, "", nil
+	}
+	chirps = chirps[:q.Page.Limit]
+	return chirps, encodeCursor(cursorFor(chirps[len(chirps)-1])), nil
+}
+
+func (s *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	return scanChirp(s.db.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ? AND deleted_at IS NULL AND hidden_at IS NULL", id))
+}
+
+func (s *SQLiteDB) GetChirpByPublicId(publicId string) (Chirp, error) {
+	return scanChirp(s.db.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE public_id = ? AND deleted_at IS NULL AND hidden_at IS NULL", publicId))
+}
+
+// ReportChirp files a report and hides the chirp once it has
+// hideAfter open reports, see DB.ReportChirp
+func (s *SQLiteDB) ReportChirp(chirpId int, reporterId int, reason string, hideAfter int) (Report, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ? AND deleted_at IS NULL AND hidden_at IS NULL", chirpId))
+	if err != nil {
+		return Report{}, err
+	}
+
+	var reported bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM reports WHERE chirp_id = ? AND reporter_id = ?)", chirpId, reporterId).Scan(&reported)
+	if err != nil {
+		return Report{}, err
+	}
+	if reported {
+		return Report{}, ErrAlreadyReported
+	}
+
+	report := Report{
+		ChirpId:    chirpId,
+		ReporterId: reporterId,
+		Reason:     reason,
+		ChirpBody:  chirp.Body,
+		Status:     "open",
+		CreatedAt:  time.Now().UTC(),
+	}
+	res, err := tx.Exec("INSERT INTO reports (chirp_id, reporter_id, reason, chirp_body, status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		report.ChirpId, report.ReporterId, report.Reason, report.ChirpBody, report.Status, report.CreatedAt)
+	if err != nil {
+		return Report{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Report{}, err
+	}
+	report.Id = int(id)
+
+	if hideAfter > 0 {
+		var open int
+		err = tx.QueryRow("SELECT count(*) FROM reports WHERE chirp_id = ? AND status = 'open'", chirpId).Scan(&open)
+		if err != nil {
+			return Report{}, err
+		}
+		if open >= hideAfter {
+			_, err = tx.Exec("UPDATE chirps SET hidden_at = ? WHERE id = ?", report.CreatedAt, chirpId)
+			if err != nil {
+				return Report{}, err
+			}
+		}
+	}
+	return report, tx.Commit()
+}
+
+const sqliteReportColumns = "id, chirp_id, reporter_id, reason, chirp_body, status, created_at, resolved_at"
+
+func scanReport(row interface{ Scan(...interface{}) error }) (Report, error) {
+	report := Report{}
+	var resolvedAt sql.NullTime
+	err := row.Scan(&report.Id, &report.ChirpId, &report.ReporterId, &report.Reason, &report.ChirpBody, &report.Status, &report.CreatedAt, &resolvedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Report{}, ErrNotFound
+	}
+	if err != nil {
+		return Report{}, err
+	}
+	if resolvedAt.Valid {
+		report.ResolvedAt = &resolvedAt.Time
+	}
+	return report, nil
+}
+
+func (s *SQLiteDB) GetReports(status string) ([]Report, error) {
+	rows, err := s.db.Query("SELECT "+sqliteReportColumns+" FROM reports WHERE ? = '' OR status = ? ORDER BY id", status, status)
+	if err != nil {
+		return []Report{}, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return []Report{}, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// ResolveReport hides the chirp or dismisses the report, closing
+// every open report on the chirp, see DB.ResolveReport
+func (s *SQLiteDB) ResolveReport(reportId int, hide bool) (Report, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	report, err := scanReport(tx.QueryRow("SELECT "+sqliteReportColumns+" FROM reports WHERE id = ?", reportId))
+	if err != nil {
+		return Report{}, err
+	}
+
+	now := time.Now().UTC()
+	status := "dismissed"
+	if hide {
+		status = "hidden"
+		_, err = tx.Exec("UPDATE chirps SET hidden_at = coalesce(hidden_at, ?) WHERE id = ?", now, report.ChirpId)
+	} else {
+		_, err = tx.Exec("UPDATE chirps SET hidden_at = NULL WHERE id = ?", report.ChirpId)
+	}
+	if err != nil {
+		return Report{}, err
+	}
+
+	_, err = tx.Exec("UPDATE reports SET status = ?, resolved_at = ? WHERE id = ? OR (chirp_id = ? AND status = 'open')",
+		status, now, reportId, report.ChirpId)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report.Status = status
+	report.ResolvedAt = &now
+	return report, tx.Commit()
+}
+
+func (s *SQLiteDB) queryChirps(query string, args ...interface{}) ([]Chirp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+// nullString stores "" as NULL so unique indexes ignore it
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// utcPtr is t in UTC, or NULL when there is no t
+func utcPtr(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+func (s *SQLiteDB) CreateUser(email string, hashed_password string) (UserOut, error) {
+	now := time.Now().UTC()
+	user := User{
+		PublicId:     newPublicId(),
+		Email:        email,
+		Password:     hashed_password,
+		Role:         roleUser,
+		Subscription: noSubscription,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	res, err := s.db.Exec("INSERT INTO users (public_id, email, password, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		nullString(user.PublicId), user.Email, user.Password, user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		return UserOut{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return UserOut{}, err
+	}
+	user.Id = int(id)
+
+	return toUserOut(user), nil
+}
+
+func (s *SQLiteDB) UpdateUser(user_id int, email string, hashed_password string) (UserOut, error) {
+	_, err := s.db.Exec("UPDATE users SET email = ?, password = ?, updated_at = ? WHERE id = ?",
+		email, hashed_password, time.Now().UTC(), user_id)
+	if err != nil {
+		return UserOut{}, err
+	}
+
+	user, err := s.GetUserById(user_id)
+	if err != nil {
+		return UserOut{}, err
+	}
+	return toUserOut(user), nil
+}
+
+const sqliteUserColumns = "id, public_id, email, password, is_chirpy_red, role, token_version, created_at, updated_at, " +
+	"plan, subscription_status, subscription_started_at, subscription_renewed_at, subscription_expires_at, subscription_cancelled_at"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	user := User{}
+	var publicId sql.NullString
+	var startedAt, renewedAt, expiresAt, cancelledAt sql.NullTime
+	err := row.Scan(&user.Id, &publicId, &user.Email, &user.Password, &user.IsChirpyRed, &user.Role, &user.TokenVersion, &user.CreatedAt, &user.UpdatedAt,
+		&user.Subscription.Plan, &user.Subscription.Status, &startedAt, &renewedAt, &expiresAt, &cancelledAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user.PublicId = publicId.String
+	user.Subscription.StartedAt = nullTimePtr(startedAt)
+	user.Subscription.RenewedAt = nullTimePtr(renewedAt)
+	user.Subscription.ExpiresAt = nullTimePtr(expiresAt)
+	user.Subscription.CancelledAt = nullTimePtr(cancelledAt)
+	return user, nil
+}
+
+func (s *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE email = ?", email))
+}
+
+func (s *SQLiteDB) GetUserById(id int) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", id))
+}
+
+func (s *SQLiteDB) UserExists(email string) bool {
+	_, err := s.GetUserByEmail(email)
+	return err == nil
+}
+
+// SetUserRole changes the role of a user and, when it really changes,
+// revokes their access tokens in the same statement, see DB.SetUserRole
+func (s *SQLiteDB) SetUserRole(userId int, role string) (UserOut, error) {
+	res, err := s.db.Exec("UPDATE users SET token_version = token_version + (role <> ?), role = ?, updated_at = ? WHERE id = ?",
+		role, role, time.Now().UTC(), userId)
+	if err != nil {
+		return UserOut{}, err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return UserOut{}, err
+	}
+	if updated == 0 {
+		return UserOut{}, ErrNotFound
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return UserOut{}, err
+	}
+	return toUserOut(user), nil
+}
+
+// UpdateSubscription runs fn in a transaction, see DB.UpdateSubscription
+func (s *SQLiteDB) UpdateSubscription(userId int, fn func(sub Subscription) Subscription) (UserOut, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserOut{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", userId))
+	if err != nil {
+		return UserOut{}, err
+	}
+
+	user.Subscription = fn(user.Subscription)
+	user.IsChirpyRed = user.Subscription.Plan == planChirpyRed
+	user.UpdatedAt = time.Now().UTC()
+	sub := user.Subscription
+	_, err = tx.Exec(`UPDATE users SET is_chirpy_red = ?, plan = ?, subscription_status = ?, subscription_started_at = ?,
+		subscription_renewed_at = ?, subscription_expires_at = ?, subscription_cancelled_at = ?, updated_at = ? WHERE id = ?`,
+		user.IsChirpyRed, sub.Plan, sub.Status, utcPtr(sub.StartedAt), utcPtr(sub.RenewedAt), utcPtr(sub.ExpiresAt), utcPtr(sub.CancelledAt), user.UpdatedAt, userId)
+	if err != nil {
+		return UserOut{}, err
+	}
+	return toUserOut(user), tx.Commit()
+}
+
+// ExpireSubscriptions ends lapsed subscriptions, the same ones
+// Subscription.lapsed picks
+func (s *SQLiteDB) ExpireSubscriptions(now time.Time, grace time.Duration) (int, error) {
+	res, err := s.db.Exec(`UPDATE users SET is_chirpy_red = 0, plan = 'free', subscription_status = 'expired', updated_at = ?
+		WHERE plan = 'chirpy_red' AND subscription_expires_at IS NOT NULL AND (
+			(subscription_status = 'cancelled' AND subscription_expires_at < ?) OR subscription_expires_at < ?)`,
+		now.UTC(), now.UTC(), now.Add(-grace).UTC())
+	if err != nil {
+		return 0, err
+	}
+	expired, err := res.RowsAffected()
+	return int(expired), err
+}
+
+func (s *SQLiteDB) CreateSession(userId int, token string, userAgent string, ip string, expiresAt time.Time) (Session, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	session := Session{
+		UserId:     userId,
+		TokenHash:  hashToken(token),
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  expiresAt.UTC(),
+	}
+	res, err := tx.Exec("INSERT INTO sessions (token_hash, user_id, user_agent, ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		session.TokenHash, session.UserId, session.UserAgent, session.IP, session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Session{}, err
+	}
+	session.Id = int(id)
+	session.FamilyId = int(id)
+
+	_, err = tx.Exec("UPDATE sessions SET family_id = id WHERE id = ?", id)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, tx.Commit()
+}
+
+const sqliteSessionColumns = "id, family_id, user_id, token_hash, user_agent, ip, created_at, last_used_at, expires_at, rotated_at"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+	session := Session{}
+	var rotatedAt sql.NullTime
+	err := row.Scan(&session.Id, &session.FamilyId, &session.UserId, &session.TokenHash, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &rotatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if rotatedAt.Valid {
+		session.RotatedAt = &rotatedAt.Time
+	}
+	return session, nil
+}
+
+// currentSession looks up the session of a refresh token, revoking
+// its family when the token was rotated more than grace ago, see
+// DB.currentSession. The caller must commit tx even on ErrTokenReused.
+func currentSession(tx *sql.Tx, token string, now time.Time, grace time.Duration) (Session, error) {
+	session, err := scanSession(tx.QueryRow("SELECT "+sqliteSessionColumns+" FROM sessions WHERE token_hash = ? AND expires_at > ?", hashToken(token), now))
+	if err != nil {
+		return Session{}, err
+	}
+	if !tokenMatches(session.TokenHash, token) {
+		return Session{}, ErrNotFound
+	}
+	if session.RotatedAt != nil && now.Sub(*session.RotatedAt) > grace {
+		_, err = tx.Exec("DELETE FROM sessions WHERE family_id = ?", session.FamilyId)
+		if err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrTokenReused
+	}
+	return session, nil
+}
+
+func (s *SQLiteDB) RefreshTokenValid(token string) (User, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	session, err := currentSession(tx, token, now, 0)
+	if errors.Is(err, ErrNotFound) {
+		return User{}, false, nil
+	} else if errors.Is(err, ErrTokenReused) {
+		return User{}, false, tx.Commit()
+	} else if err != nil {
+		return User{}, false, err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET last_used_at = ? WHERE id = ?", now, session.Id)
+	if err != nil {
+		return User{}, false, err
+	}
+	user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", session.UserId))
+	if errors.Is(err, ErrNotFound) {
+		return User{}, false, nil
+	} else if err != nil {
+		return User{}, false, err
+	}
+	return user, true, tx.Commit()
+}
+
+// RotateRefreshToken retires token and puts newToken in its place,
+// see DB.RotateRefreshToken
+func (s *SQLiteDB) RotateRefreshToken(token string, newToken string, grace time.Duration) (User, Session, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	session, err := currentSession(tx, token, now, grace)
+	if errors.Is(err, ErrTokenReused) {
+		commitErr := tx.Commit()
+		if commitErr != nil {
+			return User{}, Session{}, commitErr
+		}
+		return User{}, Session{}, err
+	} else if err != nil {
+		return User{}, Session{}, err
+	}
+
+	user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", session.UserId))
+	if err != nil {
+		return User{}, Session{}, err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET rotated_at = ? WHERE id = ? AND rotated_at IS NULL", now, session.Id)
+	if err != nil {
+		return User{}, Session{}, err
+	}
+
+	rotated := session
+	rotated.RotatedAt = nil
+	rotated.TokenHash = hashToken(newToken)
+	rotated.LastUsedAt = now
+	res, err := tx.Exec("INSERT INTO sessions (family_id, token_hash, user_id, user_agent, ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		rotated.FamilyId, rotated.TokenHash, rotated.UserId, rotated.UserAgent, rotated.IP, rotated.CreatedAt.UTC(), rotated.LastUsedAt, rotated.ExpiresAt.UTC())
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	rotated.Id = int(id)
+
+	return user, rotated, tx.Commit()
+}
+
+// RevokeToken ends the session of a refresh token, with its whole family
+func (s *SQLiteDB) RevokeToken(token string) error {
+	session, err := scanSession(s.db.QueryRow("SELECT "+sqliteSessionColumns+" FROM sessions WHERE token_hash = ?", hashToken(token)))
+	if errors.Is(err, ErrNotFound) || (err == nil && !tokenMatches(session.TokenHash, token)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("DELETE FROM sessions WHERE family_id = ?", session.FamilyId)
+	return err
+}
+
+// GetSessions lists the current token of each session of a user
+func (s *SQLiteDB) GetSessions(userId int) ([]Session, error) {
+	rows, err := s.db.Query("SELECT "+sqliteSessionColumns+" FROM sessions WHERE id IN "+
+		"(SELECT MAX(id) FROM sessions WHERE user_id = ? AND rotated_at IS NULL AND expires_at > ? GROUP BY family_id) ORDER BY family_id DESC",
+		userId, time.Now().UTC())
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return []Session{}, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession ends a session of a user, sessionId is its family id
+func (s *SQLiteDB) DeleteSession(userId int, sessionId int) error {
+	res, err := s.db.Exec("DELETE FROM sessions WHERE family_id = ? AND user_id = ?", sessionId, userId)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) PurgeExpiredSessions(before time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM sessions WHERE expires_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
+
+func (s *SQLiteDB) RevokeAccessToken(tokenId string, userId int, expiresAt time.Time) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?)", tokenId, userId, expiresAt.UTC())
+	return err
+}
+
+// AccessTokenRevoked checks the denylist and the token version in one query
+func (s *SQLiteDB) AccessTokenRevoked(tokenId string, userId int, tokenVersion int) (bool, error) {
+	revoked := false
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR NOT EXISTS (SELECT 1 FROM users WHERE id = ? AND token_version = ?)`, tokenId, userId, tokenVersion).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *SQLiteDB) RevokeAllTokens(userId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET token_version = token_version + 1, updated_at = ? WHERE id = ?", time.Now().UTC(), userId)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) PurgeRevokedTokens(before time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
+
+const sqliteWebhookEventColumns = "id, source, event_id, event, payload, status, error, attempts, received_at, processed_at"
+
+func scanWebhookEvent(row interface{ Scan(...interface{}) error }) (WebhookEvent, error) {
+	event := WebhookEvent{}
+	var payload string
+	var processedAt sql.NullTime
+	err := row.Scan(&event.Id, &event.Source, &event.EventId, &event.Event, &payload, &event.Status, &event.Error, &event.Attempts, &event.ReceivedAt, &processedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebhookEvent{}, ErrNotFound
+	}
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+	event.Payload = json.RawMessage(payload)
+	if processedAt.Valid {
+		event.ProcessedAt = &processedAt.Time
+	}
+	return event, nil
+}
+
+// RecordWebhookEvent returns the event already in the inbox with the
+// same id, if there is one, see DB.RecordWebhookEvent
+func (s *SQLiteDB) RecordWebhookEvent(source string, eventId string, event string, payload []byte) (WebhookEvent, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return WebhookEvent{}, false, err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanWebhookEvent(tx.QueryRow("SELECT "+sqliteWebhookEventColumns+" FROM webhook_events WHERE source = ? AND event_id = ?", source, eventId))
+	if err == nil {
+		return existing, false, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return WebhookEvent{}, false, err
+	}
+
+	recorded := WebhookEvent{
+		Source:     source,
+		EventId:    eventId,
+		Event:      event,
+		Payload:    json.RawMessage(payload),
+		Status:     "received",
+		ReceivedAt: time.Now().UTC(),
+	}
+	res, err := tx.Exec("INSERT INTO webhook_events (source, event_id, event, payload, status, received_at) VALUES (?, ?, ?, ?, ?, ?)",
+		recorded.Source, recorded.EventId, recorded.Event, string(payload), recorded.Status, recorded.ReceivedAt)
+	if err != nil {
+		return WebhookEvent{}, false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return WebhookEvent{}, false, err
+	}
+	recorded.Id = int(id)
+	return recorded, true, tx.Commit()
+}
+
+func (s *SQLiteDB) FinishWebhookEvent(id int, status string, errMsg string) (WebhookEvent, error) {
+	res, err := s.db.Exec("UPDATE webhook_events SET status = ?, error = ?, attempts = attempts + 1, processed_at = ? WHERE id = ?", status, errMsg, time.Now().UTC(), id)
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+	if updated == 0 {
+		return WebhookEvent{}, ErrNotFound
+	}
+	return s.GetWebhookEvent(id)
+}
+
+func (s *SQLiteDB) GetWebhookEvents(status string) ([]WebhookEvent, error) {
+	rows, err := s.db.Query("SELECT "+sqliteWebhookEventColumns+" FROM webhook_events WHERE ? = '' OR status = ? ORDER BY id", status, status)
+	if err != nil {
+		return []WebhookEvent{}, err
+	}
+	defer rows.Close()
+
+	events := []WebhookEvent{}
+	for rows.Next() {
+		event, err := scanWebhookEvent(rows)
+		if err != nil {
+			return []WebhookEvent{}, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteDB) GetWebhookEvent(id int) (WebhookEvent, error) {
+	return scanWebhookEvent(s.db.QueryRow("SELECT "+sqliteWebhookEventColumns+" FROM webhook_events WHERE id = ?", id))
+}
+
+// the events of an endpoint are kept comma separated
+const sqliteWebhookEndpointColumns = "id, user_id, url, events, all_users, secret, created_at"
+
+func scanWebhookEndpoint(row interface{ Scan(...interface{}) error }) (WebhookEndpoint, error) {
+	endpoint := WebhookEndpoint{}
+	var events string
+	err := row.Scan(&endpoint.Id, &endpoint.UserId, &endpoint.URL, &events, &endpoint.AllUsers, &endpoint.Secret, &endpoint.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebhookEndpoint{}, ErrNotFound
+	}
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	endpoint.Events = strings.Split(events, ",")
+	return endpoint, nil
+}
+
+func (s *SQLiteDB) CreateWebhookEndpoint(userId int, url string, events []string, allUsers bool, secret string) (WebhookEndpoint, error) {
+	endpoint := WebhookEndpoint{
+		UserId:    userId,
+		URL:       url,
+		Events:    append([]string(nil), events...),
+		AllUsers:  allUsers,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	res, err := s.db.Exec("INSERT INTO webhook_endpoints (user_id, url, events, all_users, secret, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		endpoint.UserId, endpoint.URL, strings.Join(endpoint.Events, ","), endpoint.AllUsers, endpoint.Secret, endpoint.CreatedAt)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	endpoint.Id = int(id)
+	return endpoint, nil
+}
+
+func (s *SQLiteDB) GetWebhookEndpoints(userId int) ([]WebhookEndpoint, error) {
+	rows, err := s.db.Query("SELECT "+sqliteWebhookEndpointColumns+" FROM webhook_endpoints WHERE user_id = ? ORDER BY id", userId)
+	if err != nil {
+		return []WebhookEndpoint{}, err
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return []WebhookEndpoint{}, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, rows.Err()
+}
+
+func (s *SQLiteDB) GetWebhookEndpoint(id int) (WebhookEndpoint, error) {
+	return scanWebhookEndpoint(s.db.QueryRow("SELECT "+sqliteWebhookEndpointColumns+" FROM webhook_endpoints WHERE id = ?", id))
+}
+
+// DeleteWebhookEndpoint relies on ON DELETE CASCADE for the deliveries
+func (s *SQLiteDB) DeleteWebhookEndpoint(id int) error {
+	res, err := s.db.Exec("DELETE FROM webhook_endpoints WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// EnqueueWebhookDeliveries queues payload for the endpoints that get
+// it, in one statement, see DB.EnqueueWebhookDeliveries
+func (s *SQLiteDB) EnqueueWebhookDeliveries(event string, userId int, payload []byte) (int, error) {
+	now := time.Now().UTC()
+	res, err := s.db.Exec(`INSERT INTO webhook_deliveries (endpoint_id, event, payload, status, next_attempt_at, created_at)
+		SELECT e.id, ?, ?, 'pending', ?, ? FROM webhook_endpoints e JOIN users u ON u.id = e.user_id
+		WHERE (e.user_id = ? OR (e.all_users = 1 AND u.role = ?)) AND instr(',' || e.events || ',', ',' || ? || ',') > 0
+		ORDER BY e.id`,
+		event, string(payload), now, now, userId, roleAdmin, event)
+	if err != nil {
+		return 0, err
+	}
+	queued, err := res.RowsAffected()
+	return int(queued), err
+}
+
+const sqliteWebhookDeliveryColumns = "id, endpoint_id, event, payload, status, attempts, next_attempt_at, last_error, response_code, created_at, delivered_at"
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	var payload string
+	var deliveredAt sql.NullTime
+	err := row.Scan(&delivery.Id, &delivery.EndpointId, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+		&delivery.NextAttemptAt, &delivery.LastError, &delivery.ResponseCode, &delivery.CreatedAt, &deliveredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebhookDelivery{}, ErrNotFound
+	}
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	delivery.DeliveredAt = nullTimePtr(deliveredAt)
+	return delivery, nil
+}
+
+func (s *SQLiteDB) queryWebhookDeliveries(query string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []WebhookDelivery{}, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return []WebhookDelivery{}, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQLiteDB) DueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	return s.queryWebhookDeliveries("SELECT "+sqliteWebhookDeliveryColumns+" FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= ? ORDER BY id LIMIT ?", now.UTC(), limit)
+}
+
+// PurgeDeliveredWebhooks deletes deliveries that succeeded before
+// deliveredBefore, dead ones are kept for the dead letter list
+func (s *SQLiteDB) PurgeDeliveredWebhooks(deliveredBefore time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM webhook_deliveries WHERE status = 'delivered' AND delivered_at < ?", deliveredBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
+
+func (s *SQLiteDB) SaveWebhookDelivery(delivery WebhookDelivery) error {
+	res, err := s.db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, response_code = ?, delivered_at = ?
+		WHERE id = ?`,
+		delivery.Status, delivery.Attempts, delivery.NextAttemptAt.UTC(), delivery.LastError, delivery.ResponseCode, utcPtr(delivery.DeliveredAt), delivery.Id)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) GetWebhookDeliveries(endpointId int, status string) ([]WebhookDelivery, error) {
+	return s.queryWebhookDeliveries("SELECT "+sqliteWebhookDeliveryColumns+" FROM webhook_deliveries WHERE (? = 0 OR endpoint_id = ?) AND (? = '' OR status = ?) ORDER BY id DESC",
+		endpointId, endpointId, status, status)
+}
+
+func (s *SQLiteDB) GetWebhookDelivery(id int) (WebhookDelivery, error) {
+	return scanWebhookDelivery(s.db.QueryRow("SELECT "+sqliteWebhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("does not exist")
+	ErrNotAuthorized   = errors.New("Not authorized")
+	ErrExpired         = errors.New("restore window has passed")
+	ErrAlreadyReported = errors.New("already reported")
+	ErrTokenReused     = errors.New("refresh token was already used")
+	ErrRateLimited     = errors.New("too many chirps in the last hour")
+)
+
+// Store is the persistence layer used by the api handlers.
+// DB (a JSON file) and SQLiteDB both implement it.
+type Store interface {
+	CreateChirp(body string, authorId int, perHour int) (Chirp, error)
+	DeleteChirp(chirpId int, userId int) error
+	RestoreChirp(chirpId int, userId int, deletedAfter time.Time) (Chirp, error)
+	PurgeDeletedChirps(deletedBefore time.Time) (int, error)
+	EditChirp(chirpId int, userId int, body string) (Chirp, error)
+	GetChirpHistory(chirpId int) ([]ChirpVersion, error)
+	GetChirps(q ChirpQuery) ([]Chirp, string, error)
+	GetChirp(id int) (Chirp, error)
+	GetChirpByPublicId(publicId string) (Chirp, error)
+
+	ReportChirp(chirpId int, reporterId int, reason string, hideAfter int) (Report, error)
+	GetReports(status string) ([]Report, error)
+	ResolveReport(reportId int, hide bool) (Report, error)
+
+	CreateUser(email string, hashed_password string) (UserOut, error)
+	UpdateUser(user_id int, email string, hashed_password string) (UserOut, error)
+	GetUserByEmail(email string) (User, error)
+	GetUserById(id int) (User, error)
+	UserExists(email string) bool
+	SetUserRole(userId int, role string) (UserOut, error)
+	UpdateSubscription(userId int, fn func(sub Subscription) Subscription) (UserOut, error)
+	ExpireSubscriptions(now time.Time, grace time.Duration) (int, error)
+
+	CreateSession(userId int, token string, userAgent string, ip string, expiresAt time.Time) (Session, error)
+	RefreshTokenValid(token string) (User, bool, error)
+	RotateRefreshToken(token string, newToken string, grace time.Duration) (User, Session, error)
+	RevokeToken(token string) error
+	GetSessions(userId int) ([]Session, error)
+	DeleteSession(userId int, sessionId int) error
+	PurgeExpiredSessions(before time.Time) (int, error)
+
+	RevokeAccessToken(tokenId string, userId int, expiresAt time.Time) error
+	AccessTokenRevoked(tokenId string, userId int, tokenVersion int) (bool, error)
+	RevokeAllTokens(userId int) error
+	PurgeRevokedTokens(before time.Time) (int, error)
+
+	RecordWebhookEvent(source string, eventId string, event string, payload []byte) (WebhookEvent, bool, error)
+	FinishWebhookEvent(id int, status string, errMsg string) (WebhookEvent, error)
+	GetWebhookEvents(status string) ([]WebhookEvent, error)
+	GetWebhookEvent(id int) (WebhookEvent, error)
+
+	CreateWebhookEndpoint(userId int, url string, events []string, allUsers bool, secret string) (WebhookEndpoint, error)
+	GetWebhookEndpoints(userId int) ([]WebhookEndpoint, error)
+	GetWebhookEndpoint(id int) (WebhookEndpoint, error)
+	DeleteWebhookEndpoint(id int) error
+	EnqueueWebhookDeliveries(event string, userId int, payload []byte) (int, error)
+	DueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error)
+	SaveWebhookDelivery(delivery WebhookDelivery) error
+	GetWebhookDeliveries(endpointId int, status string) ([]WebhookDelivery, error)
+	GetWebhookDelivery(id int) (WebhookDelivery, error)
+	PurgeDeliveredWebhooks(deliveredBefore time.Time) (int, error)
+
+	Close() error
+}
+
+// OpenStore opens the store for the given driver ("json" or "sqlite")
+func OpenStore(driver string, path string) (Store, error) {
+	switch driver {
+	case "", "json":
+		return NewDB(path)
+	case "sqlite":
+		return NewSQLiteDB(path)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+// RemoveStore deletes the database at path along with
+// the files the driver keeps next to it
+func RemoveStore(driver string, path string) error {
+	files := []string{path}
+	switch driver {
+	case "", "json":
+		files = append(files, path+".log", path+".tmp")
+	case "sqlite":
+		files = append(files, path+"-wal", path+"-shm")
+	}
+
+	for _, file := range files {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import "time"
+
+const (
+	planFree      = "free"
+	planChirpyRed = "chirpy_red"
+)
+
+// noSubscription is what users start with
+var noSubscription = Subscription{Plan: planFree, Status: "none"}
+
+// apply moves a subscription along for a Polka event, at now.
+// paidUntil is when Polka says the paid period ends, zero when it
+// doesn't say, in which case it runs for period.
+//
+//   - upgraded starts a subscription, or restarts an ended one
+//   - renewed extends it by a period from when it was due to end
+//   - payment_failed leaves it running, into the grace period
+//   - downgraded cancels it at the end of the paid period
+//   - refunded ends it right away
+func (sub Subscription) apply(event string, now time.Time, period time.Duration, paidUntil time.Time) Subscription {
+	subscribed := sub.Plan == planChirpyRed
+
+	switch event {
+	case "user.upgraded", "user.renewed":
+		if !subscribed {
+			sub.StartedAt = &now
+		}
+		from := now
+		if subscribed && event == "user.renewed" && sub.ExpiresAt != nil && sub.ExpiresAt.After(now) {
+			from = *sub.ExpiresAt
+		}
+		expiresAt := from.Add(period)
+		if !paidUntil.IsZero() {
+			expiresAt = paidUntil.UTC()
+		}
+		sub.Plan = planChirpyRed
+		sub.Status = "active"
+		sub.RenewedAt = &now
+		sub.ExpiresAt = &expiresAt
+		sub.CancelledAt = nil
+
+	case "user.payment_failed":
+		if subscribed && sub.Status == "active" {
+			sub.Status = "past_due"
+		}
+
+	case "user.downgraded":
+		if !subscribed {
+			break
+		}
+		sub.Status = "cancelled"
+		sub.CancelledAt = &now
+		if sub.ExpiresAt == nil {
+			// subscribed before subscriptions had an end,
+			// there is no paid period left to honor
+			sub = sub.end("expired", now)
+		}
+
+	case "user.refunded":
+		if subscribed {
+			sub = sub.end("refunded", now)
+			sub.CancelledAt = &now
+		}
+	}
+	return sub
+}
+
+// end takes the user off Chirpy Red
+func (sub Subscription) end(status string, now time.Time) Subscription {
+	sub.Plan = planFree
+	sub.Status = status
+	sub.ExpiresAt = &now
+	return sub
+}
+
+// lapsed reports whether a subscription has run out at now: a
+// cancelled one at the end of its paid period, others after grace
+func (sub Subscription) lapsed(now time.Time, grace time.Duration) bool {
+	if sub.Plan != planChirpyRed || sub.ExpiresAt == nil {
+		return false
+	}
+	if sub.Status == "cancelled" {
+		return sub.ExpiresAt.Before(now)
+	}
+	return sub.ExpiresAt.Add(grace).Before(now)
+}
+
+// UpdateSubscription replaces the subscription of a user with what fn
+// makes of it, keeping IsChirpyRed in step
+func (db *DB) UpdateSubscription(userId int, fn func(sub Subscription) Subscription) (UserOut, error) {
+	userOut := UserOut{}
+	err := db.Update(func(tx *DBStructure) error {
+		user, exists := tx.Users[userId]
+		if !exists {
+			return ErrNotFound
+		}
+
+		user.Subscription = fn(user.Subscription)
+		user.IsChirpyRed = user.Subscription.Plan == planChirpyRed
+		user.UpdatedAt = time.Now().UTC()
+		tx.put("users", userId, user)
+		userOut = toUserOut(user)
+		return nil
+	})
+	return userOut, err
+}
+
+// ExpireSubscriptions ends the subscriptions that lapsed, returning
+// how many
+func (db *DB) ExpireSubscriptions(now time.Time, grace time.Duration) (int, error) {
+	expired := 0
+	err := db.Update(func(tx *DBStructure) error {
+		for id, user := range tx.Users {
+			if !user.Subscription.lapsed(now, grace) {
+				continue
+			}
+			user.Subscription = user.Subscription.end("expired", *user.Subscription.ExpiresAt)
+			user.IsChirpyRed = false
+			user.UpdatedAt = now
+			tx.put("users", id, user)
+			expired++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
@@ -1,143 +1,81 @@
 package main
 
 import (
-	"errors"
-	"fmt"
 	"time"
 )
 
 func (db *DB) CreateUser(email string, hashed_password string) (UserOut, error) {
-	err := db.ensureDB()
-	if err != nil {
-		return UserOut{}, err
-	}
-
-	dbStructure, err := db.loadDB()
+	newUser := User{}
+	err := db.Update(func(tx *DBStructure) error {
+		userId := tx.nextId("users")
+		now := time.Now().UTC()
+
+		newUser = User{
+			Id:           userId,
+			PublicId:     newPublicId(),
+			IsChirpyRed:  false,
+			Subscription: noSubscription,
+			Role:         roleUser,
+			Email:        email,
+			Password:     hashed_password,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+		tx.put("users", userId, newUser)
+		return nil
+	})
 	if err != nil {
 		return UserOut{}, err
 	}
 
-	userId := len(dbStructure.Users) + 1
-
-	newUser := User{
-		Id:          userId,
-		IsChirpyRed: false,
-		Email:       email,
-		Password:    hashed_password,
-	}
-	if dbStructure.Users == nil {
-		dbStructure.Users = map[int]User{}
-	}
-
-	dbStructure.Users[userId] = newUser
-	err = db.writeDB(dbStructure)
-
-	userOut := UserOut{
-		Id:          userId,
-		IsChirpyRed: newUser.IsChirpyRed,
-		Email:       newUser.Email,
-	}
-
-	return userOut, err
+	return toUserOut(newUser), nil
 }
 
 func (db *DB) UpdateUser(user_id int, email string, hashed_password string) (UserOut, error) {
-	err := db.ensureDB()
-	if err != nil {
-		return UserOut{}, err
-	}
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return UserOut{}, err
-	}
-
-	userExisting, err := db.GetUserById(user_id)
-
-	dbStructure.Users[user_id] = User{
-		Id:             user_id,
-		IsChirpyRed:    userExisting.IsChirpyRed,
-		Email:          email,
-		Password:       hashed_password,
-		RefreshToken:   userExisting.RefreshToken,
-		ExpiresRefresh: userExisting.ExpiresRefresh,
-	}
+	userOut := UserOut{}
+	err := db.Update(func(tx *DBStructure) error {
+		userExisting, exists := tx.Users[user_id]
+		if !exists {
+			return ErrNotFound
+		}
 
-	err = db.writeDB(dbStructure)
+		userExisting.Email = email
+		userExisting.Password = hashed_password
+		userExisting.UpdatedAt = time.Now().UTC()
+		tx.put("users", user_id, userExisting)
 
-	userOut := UserOut{
-		Id:          user_id,
-		IsChirpyRed: userExisting.IsChirpyRed,
-		Email:       email,
-	}
+		userOut = toUserOut(userExisting)
+		return nil
+	})
 
-	return userOut, nil
+	return userOut, err
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	err := db.ensureDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return user, nil
+	found := User{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, user := range tx.Users {
+			if user.Email == email {
+				found = user
+				return nil
+			}
 		}
-	}
-	return User{}, errors.New("User email not found")
-
+		return ErrNotFound
+	})
+	return found, err
 }
 
 func (db *DB) GetUserById(id int) (User, error) {
-	err := db.ensureDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-	if user, exists := dbStructure.Users[id]; exists {
-		return user, nil
-	} else {
-		return User{}, errors.New("User email not found")
-	}
-
-}
-
-func (db *DB) AddRefreshTokenToUser(user User, token string) error {
-	err := db.ensureDB()
-	if err != nil {
-		return err
-	}
-
-	dbStructure, err := db.loadDB()
-
-	if err != nil {
-		return err
-	}
-
-	var expiresAt time.Time
-	expiresAt = time.Now().Add(1440 * time.Hour).UTC()
-
-	user.RefreshToken = token
-	user.ExpiresRefresh = expiresAt
-
-	dbStructure.Users[user.Id] = user
-
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-
-	return nil
+	found := User{}
+	err := db.View(func(tx *DBStructure) error {
+		user, exists := tx.Users[id]
+		if !exists {
+			return ErrNotFound
+		}
+		found = user
+		return nil
+	})
+	return found, err
 }
 
 func (db *DB) UserExists(email string) bool {
@@ -145,72 +83,25 @@ func (db *DB) UserExists(email string) bool {
 	return err == nil
 }
 
-func (db *DB) RefreshTokenValid(token string) (string, bool, error) {
-	db.ensureDB()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return "", false, err
-	}
-
-	nowTime := time.Now().UTC()
-
-	for _, user := range dbStructure.Users {
-		if user.RefreshToken == token {
-			fmt.Println("0", user.ExpiresRefresh)
-			fmt.Println("1", nowTime)
-			if user.ExpiresRefresh.After(nowTime) {
-				newToken := createJWT(user)
-				return newToken, true, nil
-			}
+// SetUserRole changes the role of a user. Access tokens carry the
+// role, so a change revokes the ones already issued.
+func (db *DB) SetUserRole(userId int, role string) (UserOut, error) {
+	userOut := UserOut{}
+	err := db.Update(func(tx *DBStructure) error {
+		user, exists := tx.Users[userId]
+		if !exists {
+			return ErrNotFound
 		}
-	}
-
-	return "", false, err
-}
-
-func (db *DB) RevokeToken(token string) error {
-	db.ensureDB()
 
-	dbStructure, err := db.loadDB()
-	// fmt.Println("befiore")
-	// fmt.Println(dbStructure)
-	if err != nil {
-		return err
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.RefreshToken == token {
-			if user.ExpiresRefresh.After(time.Now()) {
-				user.ExpiresRefresh = time.Now().AddDate(0, -1, 0).UTC()
-				dbStructure.Users[user.Id] = user
-			}
+		if user.Role != role {
+			user.TokenVersion++
 		}
-	}
-	// fmt.Println("after")
-	// fmt.Println(dbStructure)
-	db.writeDB(dbStructure)
-	dbStructure, err = db.loadDB()
-	// fmt.Println("after after")
-	// fmt.Println(dbStructure)
+		user.Role = role
+		user.UpdatedAt = time.Now().UTC()
+		tx.put("users", userId, user)
 
-	return nil
-}
-
-func (db *DB) UpgradeUser(userId int) error {
-	db.ensureDB()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	user := dbStructure.Users[userId]
-	user.IsChirpyRed = true
-
-	dbStructure.Users[userId] = user
-
-	db.writeDB(dbStructure)
-
-	return nil
+		userOut = toUserOut(user)
+		return nil
+	})
+	return userOut, err
 }
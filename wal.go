@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// compactEvery is how many log entries are appended
+// before the log is folded back into the snapshot
+const compactEvery = 1000
+
+// walEntry is one line of the write-ahead log. All the records of a
+// transaction live on the same line, so a torn line drops all of it.
+type walEntry struct {
+	Records []walRecord `json:"records"`
+}
+
+type walRecord struct {
+	Op    string          `json:"op"` // create, update or delete
+	Table string          `json:"table"`
+	Key   string          `json:"key"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// tables returns every map field of DBStructure by its json name
+func (dbStructure *DBStructure) tables() map[string]reflect.Value {
+	v := reflect.ValueOf(dbStructure).Elem()
+	t := v.Type()
+
+	tables := map[string]reflect.Value{}
+	for i := 0; i < t.NumField(); i++ {
+		if v.Field(i).Kind() != reflect.Map {
+			continue
+		}
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		tables[name] = v.Field(i)
+	}
+	return tables
+}
+
+// apply replays a single record onto dbStructure
+func (dbStructure *DBStructure) apply(rec walRecord) error {
+	table, ok := dbStructure.tables()[rec.Table]
+	if !ok {
+		return fmt.Errorf("unknown table %q", rec.Table)
+	}
+	if table.IsNil() {
+		table.Set(reflect.MakeMap(table.Type()))
+	}
+
+	key := reflect.New(table.Type().Key()).Elem()
+	switch key.Kind() {
+	case reflect.Int:
+		id, err := strconv.Atoi(rec.Key)
+		if err != nil {
+			return err
+		}
+		key.SetInt(int64(id))
+	case reflect.String:
+		key.SetString(rec.Key)
+	default:
+		return fmt.Errorf("unsupported key type for table %q", rec.Table)
+	}
+
+	if rec.Op == "delete" {
+		table.SetMapIndex(key, reflect.Value{})
+		return nil
+	}
+
+	value := reflect.New(table.Type().Elem())
+	err := json.Unmarshal(rec.Data, value.Interface())
+	if err != nil {
+		return err
+	}
+	table.SetMapIndex(key, value.Elem())
+	return nil
+}
+
+// journal remembers what every key a transaction touched held before
+// the transaction, so it can be logged or rolled back without looking
+// at the rest of the database
+type journal struct {
+	keys     []journalKey
+	previous map[journalKey]reflect.Value // invalid when the key was absent
+}
+
+type journalKey struct {
+	table string
+	key   any
+}
+
+// put stores value under key in table. Writes made in an Update must
+// go through put and remove, they are what gets logged.
+func (dbStructure *DBStructure) put(table string, key any, value any) {
+	dbStructure.touch(table, key).SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
+}
+
+// remove deletes key from table
+func (dbStructure *DBStructure) remove(table string, key any) {
+	dbStructure.touch(table, key).SetMapIndex(reflect.ValueOf(key), reflect.Value{})
+}
+
+// touch records the value of key before the transaction first changes
+// it and returns its table
+func (dbStructure *DBStructure) touch(table string, key any) reflect.Value {
+	if dbStructure.journal == nil {
+		panic("database written outside of Update")
+	}
+	t, ok := dbStructure.tables()[table]
+	if !ok {
+		panic(fmt.Sprintf("unknown table %q", table))
+	}
+
+	k := journalKey{table: table, key: key}
+	if _, touched := dbStructure.journal.previous[k]; !touched {
+		dbStructure.journal.previous[k] = t.MapIndex(reflect.ValueOf(key))
+		dbStructure.journal.keys = append(dbStructure.journal.keys, k)
+	}
+	return t
+}
+
+// records returns the log records for what the transaction changed
+func (dbStructure *DBStructure) records() ([]walRecord, error) {
+	tables := dbStructure.tables()
+	records := []walRecord{}
+
+	for _, k := range dbStructure.journal.keys {
+		previous := dbStructure.journal.previous[k]
+		current := tables[k.table].MapIndex(reflect.ValueOf(k.key))
+		key := fmt.Sprint(k.key)
+
+		if !current.IsValid() {
+			if previous.IsValid() {
+				records = append(records, walRecord{Op: "delete", Table: k.table, Key: key})
+			}
+			continue
+		}
+
+		op := "create"
+		if previous.IsValid() {
+			if reflect.DeepEqual(previous.Interface(), current.Interface()) {
+				continue
+			}
+			op = "update"
+		}
+		data, err := json.Marshal(current.Interface())
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, walRecord{Op: op, Table: k.table, Key: key, Data: data})
+	}
+
+	// keep the log deterministic whatever order fn wrote in
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Table != records[j].Table {
+			return records[i].Table < records[j].Table
+		}
+		return records[i].Key < records[j].Key
+	})
+	return records, nil
+}
+
+// rollback puts back every key the transaction touched
+func (dbStructure *DBStructure) rollback() {
+	tables := dbStructure.tables()
+	for k, previous := range dbStructure.journal.previous {
+		tables[k.table].SetMapIndex(reflect.ValueOf(k.key), previous)
+	}
+}
+
+// replayLog applies every complete entry of the log at path onto
+// dbStructure and returns how many entries it applied. A torn last
+// line (a crash in the middle of an append) is ignored.
+func replayLog(path string, dbStructure *DBStructure) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	entries := 0
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// no trailing newline means the append never finished
+			return entries, nil
+		}
+
+		entry := walEntry{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return entries, fmt.Errorf("corrupt log entry %d: %w", entries+1, err)
+		}
+		for _, rec := range entry.Records {
+			err = dbStructure.apply(rec)
+			if err != nil {
+				return entries, err
+			}
+		}
+		entries++
+	}
+}
+
+// appendLog writes records as a single entry and syncs it to disk
+func appendLog(path string, records []walRecord) error {
+	line, err := json.Marshal(walEntry{Records: records})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(line)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// writeSnapshot atomically replaces the snapshot at path
+func writeSnapshot(path string, dbStructure DBStructure) error {
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
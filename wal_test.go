@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReplayLog(t *testing.T) {
+	alice := `{"op":"create","table":"users","key":"1","data":{"id":1,"email":"alice@example.com"}}`
+	bob := `{"op":"create","table":"users","key":"2","data":{"id":2,"email":"bob@example.com"}}`
+	renamed := `{"op":"update","table":"users","key":"1","data":{"id":1,"email":"alice@example.org"}}`
+	deleted := `{"op":"delete","table":"users","key":"2"}`
+
+	tests := []struct {
+		name    string
+		log     string // "" for no log file at all
+		entries int
+		emails  map[int]string
+		wantErr bool
+	}{
+		{
+			name:    "no log",
+			entries: 0,
+			emails:  map[int]string{},
+		},
+		{
+			name:    "creates",
+			log:     `{"records":[` + alice + `]}` + "\n" + `{"records":[` + bob + `]}` + "\n",
+			entries: 2,
+			emails:  map[int]string{1: "alice@example.com", 2: "bob@example.com"},
+		},
+		{
+			name:    "updates and deletes",
+			log:     `{"records":[` + alice + `,` + bob + `]}` + "\n" + `{"records":[` + renamed + `,` + deleted + `]}` + "\n",
+			entries: 2,
+			emails:  map[int]string{1: "alice@example.org"},
+		},
+		{
+			name:    "torn last line",
+			log:     `{"records":[` + alice + `]}` + "\n" + `{"records":[` + bob,
+			entries: 1,
+			emails:  map[int]string{1: "alice@example.com"},
+		},
+		{
+			name:    "transaction is all or nothing",
+			log:     `{"records":[` + alice + `]}` + "\n" + `{"records":[` + renamed + `,` + bob + `]}`,
+			entries: 1,
+			emails:  map[int]string{1: "alice@example.com"},
+		},
+		{
+			name:    "corrupt entry",
+			log:     `{"records":[` + alice + `]}` + "\n" + "not json\n" + `{"records":[` + bob + `]}` + "\n",
+			entries: 1,
+			wantErr: true,
+		},
+		{
+			name:    "unknown table",
+			log:     `{"records":[{"op":"create","table":"nope","key":"1","data":{}}]}` + "\n",
+			entries: 0,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json.log")
+			if tt.log != "" {
+				err := os.WriteFile(path, []byte(tt.log), 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dbStructure := DBStructure{}
+			entries, err := replayLog(path, &dbStructure)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("replayLog() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if entries != tt.entries {
+				t.Errorf("replayLog() applied %d entries, want %d", entries, tt.entries)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(dbStructure.Users) != len(tt.emails) {
+				t.Errorf("got %d users, want %d", len(dbStructure.Users), len(tt.emails))
+			}
+			for id, email := range tt.emails {
+				if got := dbStructure.Users[id].Email; got != email {
+					t.Errorf("user %d email = %q, want %q", id, got, email)
+				}
+			}
+		})
+	}
+}
+
+func TestDBCrashRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash does whatever a crash left behind to the files of the
+		// database at path after alice and bob were committed
+		crash func(t *testing.T, path string)
+	}{
+		{
+			name:  "log not compacted",
+			crash: func(t *testing.T, path string) {},
+		},
+		{
+			name: "torn append",
+			crash: func(t *testing.T, path string) {
+				appendFile(t, path+".log", `{"records":[{"op":"create","table":"users","key":"3","da`)
+			},
+		},
+		{
+			name: "crash between snapshot and log removal",
+			crash: func(t *testing.T, path string) {
+				log, err := os.ReadFile(path + ".log")
+				if err != nil {
+					t.Fatal(err)
+				}
+				db, err := NewDB(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.Close()
+				// the snapshot now has everything, put the log back
+				err = os.WriteFile(path+".log", log, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "leftover snapshot temp file",
+			crash: func(t *testing.T, path string) {
+				appendFile(t, path+".tmp", `{"users":{"1":{"id":1,"em`)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := db.CreateUser("alice@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateUser("bob@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.UpdateUser(alice.Id, "alice@example.org", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.crash(t, path)
+
+			db, err = NewDB(path)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			if _, err := os.Stat(path + ".log"); !os.IsNotExist(err) {
+				t.Errorf("log was not compacted on open: %v", err)
+			}
+			assertUsers(t, db, map[int]string{1: "alice@example.org", 2: "bob@example.com"})
+
+			// writes after recovery land after the compacted state
+			carol, err := db.CreateUser("carol@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if carol.Id != 3 {
+				t.Errorf("carol got id %d, want 3", carol.Id)
+			}
+
+			db, err = NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertUsers(t, db, map[int]string{1: "alice@example.org", 2: "bob@example.com", 3: "carol@example.com"})
+		})
+	}
+}
+
+func TestDBCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := db.logEntries
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		_, err = db.CreateUser(email, "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.logEntries != before+2 {
+		t.Fatalf("logEntries = %d, want %d", db.logEntries, before+2)
+	}
+
+	err = db.compact(db.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.logEntries != 0 {
+		t.Errorf("logEntries = %d after compacting, want 0", db.logEntries)
+	}
+	if _, err := os.Stat(path + ".log"); !os.IsNotExist(err) {
+		t.Errorf("log still exists after compacting: %v", err)
+	}
+
+	// the snapshot alone has everything
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUsers(t, db, map[int]string{1: "alice@example.com", 2: "bob@example.com"})
+}
+
+func TestUpdateCompactionFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory in the way of the snapshot's temp file
+	err = os.Mkdir(path+".tmp", 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.logEntries = compactEvery - 1
+	alice, err := db.CreateUser("alice@example.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v after a failed compaction", err)
+	}
+	if alice.Id != 1 {
+		t.Errorf("alice got id %d, want 1", alice.Id)
+	}
+	if db.logEntries < compactEvery {
+		t.Errorf("logEntries = %d, the failed compaction should be retried", db.logEntries)
+	}
+	assertUsers(t, db, map[int]string{1: "alice@example.com"})
+
+	// the next write compacts
+	err = os.Remove(path + ".tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser("bob@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.logEntries != 0 {
+		t.Errorf("logEntries = %d, want 0 after compacting", db.logEntries)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUsers(t, db, map[int]string{1: "alice@example.com", 2: "bob@example.com"})
+}
+
+func appendFile(t *testing.T, path string, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertUsers(t *testing.T, db *DB, emails map[int]string) {
+	t.Helper()
+	for id, email := range emails {
+		user, err := db.GetUserById(id)
+		if err != nil {
+			t.Errorf("user %d: %v", id, err)
+			continue
+		}
+		if user.Email != email {
+			t.Errorf("user %d email = %q, want %q", id, user.Email, email)
+		}
+	}
+	count := 0
+	db.View(func(tx *DBStructure) error {
+		count = len(tx.Users)
+		return nil
+	})
+	if count != len(emails) {
+		t.Errorf("got %d users, want %d", count, len(emails))
+	}
+}
+
+func TestUpdateJournal(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		fn      func(tx *DBStructure) error
+		wantErr error
+		records []string // op table key of what got logged
+		emails  map[int]string
+	}{
+		{
+			name: "logs only what changed",
+			fn: func(tx *DBStructure) error {
+				alice := tx.Users[1]
+				alice.Email = "alice@example.org"
+				tx.put("users", 1, alice)
+				tx.put("users", 2, tx.Users[2]) // unchanged
+				return nil
+			},
+			records: []string{"update users 1"},
+			emails:  map[int]string{1: "alice@example.org", 2: "bob@example.com"},
+		},
+		{
+			name: "create and delete",
+			fn: func(tx *DBStructure) error {
+				tx.put("users", 3, User{Id: 3, Email: "carol@example.com"})
+				tx.remove("users", 2)
+				return nil
+			},
+			records: []string{"create users 3", "delete users 2"},
+			emails:  map[int]string{1: "alice@example.com", 3: "carol@example.com"},
+		},
+		{
+			name: "created then removed in the same transaction",
+			fn: func(tx *DBStructure) error {
+				tx.put("users", 3, User{Id: 3, Email: "carol@example.com"})
+				tx.remove("users", 3)
+				return nil
+			},
+			emails: map[int]string{1: "alice@example.com", 2: "bob@example.com"},
+		},
+		{
+			name: "failed transaction is rolled back",
+			fn: func(tx *DBStructure) error {
+				alice := tx.Users[1]
+				alice.Email = "alice@example.org"
+				tx.put("users", 1, alice)
+				tx.remove("users", 2)
+				tx.put("users", 3, User{Id: 3, Email: "carol@example.com"})
+				return errFailed
+			},
+			wantErr: errFailed,
+			emails:  map[int]string{1: "alice@example.com", 2: "bob@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, email := range []string{"alice@example.com", "bob@example.com"} {
+				_, err = db.CreateUser(email, "hash")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = db.compact(db.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.Update(tt.fn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Update() error = %v, want %v", err, tt.wantErr)
+			}
+
+			logged := []string{}
+			data, err := os.ReadFile(path + ".log")
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if line == "" {
+					continue
+				}
+				entry := walEntry{}
+				err = json.Unmarshal([]byte(line), &entry)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, rec := range entry.Records {
+					logged = append(logged, rec.Op+" "+rec.Table+" "+rec.Key)
+				}
+			}
+			sort.Strings(logged)
+			want := append([]string{}, tt.records...)
+			sort.Strings(want)
+			if strings.Join(logged, ",") != strings.Join(want, ",") {
+				t.Errorf("logged %v, want %v", logged, want)
+			}
+
+			assertUsers(t, db, tt.emails)
+			db, err = NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertUsers(t, db, tt.emails)
+		})
+	}
+}
+
+func TestNextIdWithoutSequences(t *testing.T) {
+	tx := &DBStructure{
+		Chirps:    map[int]Chirp{3: {Id: 3}, 7: {Id: 7}},
+		Sessions:  map[string]Session{"hash-a": {Id: 4}, "hash-b": {Id: 9}},
+		Sequences: map[string]int{},
+	}
+	tx.journal = &journal{previous: map[journalKey]reflect.Value{}}
+
+	tests := []struct {
+		table string
+		want  int
+	}{
+		{"chirps", 8},
+		{"chirps", 9},
+		{"sessions", 10},
+		{"users", 1},
+		{"webhook_deliveries", 1},
+	}
+	for _, tt := range tests {
+		if got := tx.nextId(tt.table); got != tt.want {
+			t.Errorf("nextId(%q) = %d, want %d", tt.table, got, tt.want)
+		}
+	}
+
+	for table := range tx.tables() {
+		if _, ok := sequenced[table]; ok {
+			continue
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("nextId(%q) didn't panic for a table without a sequence", table)
+				}
+			}()
+			tx.nextId(table)
+		}()
+	}
+}